@@ -19,7 +19,7 @@
 package config
 
 import (
-	"encoding/json"
+	"fmt"
 
 	"github.com/dylenfu/zion-makeup/pkg/files"
 )
@@ -30,15 +30,84 @@ type Config struct {
 	IpList      []string
 	StartPort   int
 	InitBalance string
+
+	// ChainID denotes the chain id of genesis, and Nodes the number of validators generated if
+	// the `-nodes` flag is not set.
+	ChainID uint64
+	Nodes   int
+
+	// HostLabels denotes the failure domains of hosts in IpList, e.g. rack, zone and provider,
+	// validators are spread so that no single domain holds more than f of them.
+	HostLabels map[string]map[string]string
+
+	// FaultTolerance denotes the target number of faulty validators f the network should tolerate,
+	// which requires at least 3f+1 validators.
+	FaultTolerance int
+
+	// Uid and Gid denote the optional owner of generated files, the current user is kept if not set.
+	Uid *int
+	Gid *int
+
+	// OperatorKey denotes the hex private key file used to sign the manifest, and OperatorAddress
+	// the trusted signer when verifying it, which defaults to the address of OperatorKey.
+	OperatorKey     string
+	OperatorAddress string
+
+	Predeploys []*Predeploy
+	StateDump  *StateDump
+}
+
+// Predeploy denotes a contract placed in the genesis alloc. the runtime bytecode is read from a
+// hardhat, foundry or solc json artifact, in which the contract is selected by Name, or given in Code
+// if no artifact is set.
+type Predeploy struct {
+	Name     string
+	Artifact string
+	Code     string
+	Address  string
+	Balance  string
+	Storage  map[string]string
 }
 
-func LoadConfig(filepath string) {
+func defaultConfig() *Config {
+	return &Config{
+		IpList:      []string{"127.0.0.1"},
+		StartPort:   30300,
+		InitBalance: "100000000000000000000000000000",
+		ChainID:     60801,
+		Nodes:       7,
+	}
+}
+
+// LoadConfig merges the defaults, the config file in json, yaml or toml chosen by extension, the
+// overrides of environment env in the file and the environment variables, later ones take precedence.
+// command line flags are applied on top of them by `Override`, and the result should be checked
+// by `Validate`.
+func LoadConfig(filepath, env string) error {
+	Conf = defaultConfig()
+	Sources = make(map[string]string)
+
 	enc, err := files.ReadFile(filepath)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("read config failed, err: %v", err)
 	}
 
-	if err := json.Unmarshal(enc, Conf); err != nil {
-		panic(err)
-	}
+	errs := make(Errors, 0)
+	loadFile(filepath, enc, env, &errs)
+	loadEnv(&errs)
+	return errs.err()
+}
+
+// StateDump denotes a `geth dump` style state export used as the base alloc of genesis, files
+// end with `.jsonl` are read as the iterative dump format with one account per line.
+type StateDump struct {
+	Path string
+
+	// Include keeps only the listed accounts if not empty, and Exclude drops the listed accounts.
+	Include []string
+	Exclude []string
+
+	// Balance rewrites the balance of all dumped accounts if set, Balances rewrites single accounts.
+	Balance  string
+	Balances map[string]string
 }
@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "zion-makeup-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	p := path.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	cases := map[string]string{
+		"config.json": `{"IpList": ["10.0.0.1", "10.0.0.2"], "StartPort": 30400}`,
+		"config.yaml": "IpList:\n  - 10.0.0.1\n  - 10.0.0.2\nStartPort: 30400\n",
+		"config.toml": "IpList = [\"10.0.0.1\", \"10.0.0.2\"]\nStartPort = 30400\n",
+	}
+	for name, content := range cases {
+		p := writeConfig(t, name, content)
+		if err := LoadConfig(p, "local"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := Validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(Conf.IpList) != 2 || Conf.StartPort != 30400 || Conf.InitBalance != defaultConfig().InitBalance {
+			t.Fatalf("%s: unexpected config %+v", name, Conf)
+		}
+		if Sources["StartPort"] != "file:"+p {
+			t.Fatalf("%s: unexpected source %s", name, Sources["StartPort"])
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	p := writeConfig(t, "config.json", `{"StartPort": 30400}`)
+	os.Setenv(EnvPrefix+"STARTPORT", "30500")
+	defer os.Unsetenv(EnvPrefix + "STARTPORT")
+
+	if err := LoadConfig(p, "local"); err != nil {
+		t.Fatal(err)
+	}
+	if Conf.StartPort != 30500 || Sources["StartPort"] != "env:ZION_MAKEUP_STARTPORT" {
+		t.Fatalf("env should override file, got %d from %s", Conf.StartPort, Sources["StartPort"])
+	}
+	if err := Override("StartPort", "30600", "flag:-start-port"); err != nil {
+		t.Fatal(err)
+	}
+	if Conf.StartPort != 30600 {
+		t.Fatalf("flag should override env, got %d", Conf.StartPort)
+	}
+}
+
+func TestLoadConfigStrict(t *testing.T) {
+	p := writeConfig(t, "config.json", `{
+		"Iplist": ["10.0.0.1"],
+		"IpLists": ["10.0.0.2"],
+		"StartPort": "30300",
+		"Predeploys": [{"Address": "0x1", "Code": "0x00", "Foo": 1}]
+	}`)
+	err := LoadConfig(p, "local")
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, expect := range []string{"Iplist: unknown field", "IpLists: unknown field", "StartPort:", "Predeploys[0].Foo: unknown field"} {
+		if !strings.Contains(err.Error(), expect) {
+			t.Errorf("missing %q in %v", expect, err)
+		}
+	}
+}
+
+func TestLoadConfigDuplicateKeys(t *testing.T) {
+	cases := map[string]string{
+		"config.json": `{"StartPort": 30400, "HostLabels": {"10.0.0.1": {"zone": "a", "zone": "b"}}, "StartPort": 30500}`,
+		"config.yaml": "StartPort: 30400\nHostLabels:\n  10.0.0.1:\n    zone: a\n    zone: b\nStartPort: 30500\n",
+	}
+	for name, content := range cases {
+		err := LoadConfig(writeConfig(t, name, content), "local")
+		if err == nil {
+			t.Fatalf("%s: expect errors", name)
+		}
+		for _, expect := range []string{"StartPort: duplicate key", "HostLabels.10.0.0.1.zone: duplicate key"} {
+			if !strings.Contains(err.Error(), expect) {
+				t.Errorf("%s: missing %q in %v", name, expect, err)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	Conf = defaultConfig()
+	Conf.IpList = []string{"10.0.0.1", "10.0.0.x"}
+	Conf.StartPort = 65530
+	Conf.InitBalance = "1e18"
+	Conf.HostLabels = map[string]map[string]string{"10.0.0.3": {"zone": "a"}}
+	Conf.StateDump = &StateDump{Path: "dump.json", Balance: "0x10", Balances: map[string]string{"0x1": "abc"}}
+	Conf.Predeploys = []*Predeploy{{
+		Name:     "Multicall",
+		Artifact: "Multicall.json",
+		Code:     "0x00",
+		Address:  "0x0000000000000000000000000000000000001000",
+	}}
+
+	err := Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	errs := err.(Errors)
+	expect := []string{
+		"HostLabels[10.0.0.3]",
+		"InitBalance",
+		"IpList[1]",
+		"Predeploys[0]: Artifact and Code are exclusive",
+		"StartPort",
+		"StateDump.Balances[0x1]: invalid address",
+		"StateDump.Balances[0x1]: invalid balance",
+	}
+	if len(errs) != len(expect) {
+		t.Fatalf("expect %d errors, got %v", len(expect), err)
+	}
+	for i, v := range expect {
+		if !strings.HasPrefix(errs[i], v) {
+			t.Errorf("expect %s, got %s", v, errs[i])
+		}
+	}
+}
+
+func TestLoadConfigEnvironments(t *testing.T) {
+	p := writeConfig(t, "config.yaml", `
+StartPort: 30300
+ChainID: 60801
+Environments:
+  devnet:
+    IpList: [10.0.0.1, 10.0.0.2]
+    Nodes: 4
+  testnet:
+    ChainID: 60802
+    StartPort: 30400
+`)
+	if err := LoadConfig(p, "testnet"); err != nil {
+		t.Fatal(err)
+	}
+	if Conf.ChainID != 60802 || Conf.StartPort != 30400 || Conf.Nodes != 7 || len(Conf.IpList) != 1 {
+		t.Fatalf("unexpected testnet config %+v", Conf)
+	}
+	if err := LoadConfig(p, "devnet"); err != nil {
+		t.Fatal(err)
+	}
+	if Conf.ChainID != 60801 || Conf.StartPort != 30300 || Conf.Nodes != 4 || len(Conf.IpList) != 2 {
+		t.Fatalf("unexpected devnet config %+v", Conf)
+	}
+	if err := LoadConfig(p, "mainnet"); err == nil || !strings.Contains(err.Error(), "available: devnet, testnet") {
+		t.Fatalf("expect undefined environment error, got %v", err)
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	for _, name := range []string{"config.json", "config.yaml"} {
+		p := writeConfig(t, name, "")
+		if err := WriteDefault(p, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadConfig(p, "local"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := Validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := WriteDefault(p, false); err == nil {
+			t.Fatalf("%s: existing config should be kept", name)
+		}
+	}
+}
+
+// TestSchemaUpToDate checks the published schema against the config struct, run
+// `./setup schema > config.schema.json` to regenerate it.
+func TestSchemaUpToDate(t *testing.T) {
+	for _, name := range Fields() {
+		if _, ok := fieldDocs["Config."+name]; !ok {
+			t.Errorf("field %s is not described", name)
+		}
+	}
+
+	published, err := ioutil.ReadFile("../config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := SchemaJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(published, enc) {
+		t.Fatal("config.schema.json is out of date")
+	}
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/naoina/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix denotes the prefix of environment variables which override config fields, e.g.
+// `ZION_MAKEUP_STARTPORT`.
+const EnvPrefix = "ZION_MAKEUP_"
+
+const SourceDefault = "default"
+
+// EnvironmentsKey denotes the config key of the named environments, each of which overrides the
+// shared top level fields and is selected by the `-env` flag.
+const EnvironmentsKey = "Environments"
+
+// Sources records where the effective value of each config field comes from, values are merged
+// in the order of defaults, config file, environment variables and command line flags.
+var Sources = make(map[string]string)
+
+// decodeFile decodes the config file into a generic map according to the file extension, which
+// is one of `.json`, `.yaml`, `.yml` and `.toml`. keys defined twice in a mapping are collected
+// into errs, json and yaml decoders silently keep the last one and toml rejects them itself.
+func decodeFile(path string, enc []byte, errs *Errors) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var raw yaml.MapSlice
+		if err := yaml.Unmarshal(enc, &raw); err != nil {
+			return nil, err
+		}
+		checkYamlDuplicates(errs, "", raw)
+		return normalizeYaml(raw).(map[string]interface{}), nil
+	case ".toml":
+		if err := toml.Unmarshal(enc, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	default:
+		if err := json.Unmarshal(enc, &m); err != nil {
+			return nil, err
+		}
+		if err := checkJsonDuplicates(errs, "", json.NewDecoder(bytes.NewReader(enc))); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+// normalizeYaml converts the mappings decoded by yaml into json compatible maps.
+func normalizeYaml(v interface{}) interface{} {
+	switch t := v.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{})
+		for _, item := range t {
+			m[fmt.Sprint(item.Key)] = normalizeYaml(item.Value)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = normalizeYaml(t[i])
+		}
+		return t
+	}
+	return v
+}
+
+func checkYamlDuplicates(errs *Errors, path string, v interface{}) {
+	switch t := v.(type) {
+	case yaml.MapSlice:
+		seen := make(map[string]bool)
+		for _, item := range t {
+			key := fmt.Sprint(item.Key)
+			if seen[key] {
+				errs.add(joinPath(path, key), "duplicate key")
+			}
+			seen[key] = true
+			checkYamlDuplicates(errs, joinPath(path, key), item.Value)
+		}
+	case []interface{}:
+		for i, val := range t {
+			checkYamlDuplicates(errs, fmt.Sprintf("%s[%d]", path, i), val)
+		}
+	}
+}
+
+// checkJsonDuplicates walks the json value read by dec and collects keys defined twice in an object.
+func checkJsonDuplicates(errs *Errors, path string, dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		seen := make(map[string]bool)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := tok.(string)
+			if seen[key] {
+				errs.add(joinPath(path, key), "duplicate key")
+			}
+			seen[key] = true
+			if err := checkJsonDuplicates(errs, joinPath(path, key), dec); err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := checkJsonDuplicates(errs, fmt.Sprintf("%s[%d]", path, i), dec); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	// the closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// fieldName returns the config field whose name is exactly the key. unlike encoding/json keys
+// are case sensitive, so that a typo such as `Iplist` is reported instead of being accepted.
+func fieldName(key string) (string, bool) {
+	if f, ok := reflect.TypeOf(Config{}).FieldByName(key); ok && f.Name == key {
+		return key, true
+	}
+	return "", false
+}
+
+// Fields returns the names of all config fields in declaration order.
+func Fields() []string {
+	t := reflect.TypeOf(Config{})
+	list := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		list = append(list, t.Field(i).Name)
+	}
+	return list
+}
+
+// loadFile strictly decodes the config file, unknown fields and values of wrong type are collected
+// into errs with their field paths instead of being ignored. the top level fields are shared by all
+// environments, and the fields of the selected environment in `Environments` are applied on top.
+func loadFile(path string, enc []byte, env string, errs *Errors) {
+	m, err := decodeFile(path, enc, errs)
+	if err != nil {
+		errs.add(path, "decode failed, err: %v", err)
+		return
+	}
+
+	delete(m, SchemaKey)
+	var envs map[string]interface{}
+	for key, val := range m {
+		if key != EnvironmentsKey {
+			continue
+		}
+		delete(m, key)
+		if envs, _ = val.(map[string]interface{}); envs == nil {
+			errs.add(EnvironmentsKey, "should be a mapping of environment names")
+			return
+		}
+	}
+
+	checkUnknown(errs, "", m, reflect.TypeOf(Config{}))
+	applyFields(m, "", "file:"+path, errs)
+	if envs == nil {
+		return
+	}
+
+	names := make([]string, 0, len(envs))
+	for name, val := range envs {
+		names = append(names, name)
+		fields, ok := val.(map[string]interface{})
+		if !ok {
+			errs.add(joinPath(EnvironmentsKey, name), "should be a mapping of config fields")
+			continue
+		}
+		// all environments are checked so that a typo is found before the environment is used
+		checkUnknown(errs, joinPath(EnvironmentsKey, name), fields, reflect.TypeOf(Config{}))
+	}
+	fields, ok := envs[env].(map[string]interface{})
+	if !ok {
+		sort.Strings(names)
+		errs.add(EnvironmentsKey, "environment %s not defined, available: %s", env, strings.Join(names, ", "))
+		return
+	}
+	prefix := joinPath(EnvironmentsKey, env)
+	applyFields(fields, prefix, fmt.Sprintf("file:%s (%s)", path, prefix), errs)
+}
+
+// applyFields decodes the values of all formats through json field by field, so that values of all
+// formats are converted in the same way and all type errors are reported.
+func applyFields(m map[string]interface{}, prefix, source string, errs *Errors) {
+	v := reflect.ValueOf(Conf).Elem()
+	for key, val := range m {
+		name, ok := fieldName(key)
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(val)
+		if err != nil {
+			errs.add(joinPath(prefix, name), "%v", err)
+			continue
+		}
+		ptr := reflect.New(v.FieldByName(name).Type())
+		if err := json.Unmarshal(data, ptr.Interface()); err != nil {
+			errs.add(joinPath(prefix, name), "%v", err)
+			continue
+		}
+		v.FieldByName(name).Set(ptr.Elem())
+		Sources[name] = source
+	}
+}
+
+// Override set the config field from its string form and record the source. strings and
+// integers are parsed directly, lists of strings are comma separated, and other types are json.
+func Override(name, value, source string) error {
+	f := reflect.ValueOf(Conf).Elem().FieldByName(name)
+	if !f.IsValid() {
+		return fmt.Errorf("unknown config field %s", name)
+	}
+
+	switch {
+	case f.Kind() == reflect.String:
+		f.SetString(value)
+	case f.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s from %s: invalid integer %s", name, source, value)
+		}
+		f.SetInt(int64(n))
+	case f.Kind() == reflect.Uint64:
+		n, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return fmt.Errorf("%s from %s: invalid unsigned integer %s", name, source, value)
+		}
+		f.SetUint(n)
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(value, "["):
+		list := make([]string, 0)
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+		f.Set(reflect.ValueOf(list))
+	default:
+		ptr := reflect.New(f.Type())
+		if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+			return fmt.Errorf("%s from %s: invalid json value, err: %v", name, source, err)
+		}
+		f.Set(ptr.Elem())
+	}
+	Sources[name] = source
+	return nil
+}
+
+// loadEnv applies the environment variables named by EnvPrefix and the upper case field name.
+func loadEnv(errs *Errors) {
+	for _, name := range Fields() {
+		key := EnvPrefix + strings.ToUpper(name)
+		if value, ok := os.LookupEnv(key); ok {
+			if err := Override(name, value, "env:"+key); err != nil {
+				*errs = append(*errs, err.Error())
+			}
+		}
+	}
+}
+
+// Print writes the effective config with the source of each field.
+func Print(w io.Writer) error {
+	v := reflect.ValueOf(Conf).Elem()
+	for _, name := range Fields() {
+		enc, err := json.Marshal(v.FieldByName(name).Interface())
+		if err != nil {
+			return err
+		}
+		source, ok := Sources[name]
+		if !ok {
+			source = SourceDefault
+		}
+		if _, err := fmt.Fprintf(w, "%-16s %-48s # %s\n", name, enc, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// SchemaKey denotes the key which points editors to the json schema of a json config, it is
+// ignored when the config loaded.
+const SchemaKey = "$schema"
+
+const (
+	balancePattern         = "^(0[xX][0-9a-fA-F]+|[0-9]+)$"
+	optionalBalancePattern = "^(0[xX][0-9a-fA-F]+|[0-9]*)$"
+	addressPattern         = "^(0[xX])?[0-9a-fA-F]{40}$"
+	optionalAddressPattern = "^((0[xX])?[0-9a-fA-F]{40})?$"
+)
+
+// fieldDocs describes every config field by `<type>.<field>`, it is shared by the json schema
+// and the commented default config.
+var fieldDocs = map[string]string{
+	"Config.IpList":          "Hosts on which the nodes are deployed, nodes are distributed on them in order if there are more nodes than hosts.",
+	"Config.StartPort":       "The p2p port of the first node on each host, the following nodes use the next ports.",
+	"Config.InitBalance":     "Genesis balance of each validator account, a decimal or 0x prefixed hex integer in wei.",
+	"Config.ChainID":         "Chain id of genesis.",
+	"Config.Nodes":           "Number of validators generated if the -nodes flag is not set.",
+	"Config.HostLabels":      "Failure domains of the hosts in IpList such as zone and rack, validators are spread so that no single domain holds more than f of them.",
+	"Config.FaultTolerance":  "Target number of faulty validators f the network should tolerate, which requires at least 3f+1 validators.",
+	"Config.Uid":             "Owner uid of generated files, the current user is kept if not set.",
+	"Config.Gid":             "Owner gid of generated files, the current group is kept if not set.",
+	"Config.OperatorKey":     "Hex private key file used to sign MANIFEST.json.",
+	"Config.OperatorAddress": "Trusted signer of MANIFEST.json when verifying it, defaults to the address of OperatorKey.",
+	"Config.Predeploys":      "Contracts placed in the genesis alloc so that they exist at block 0.",
+	"Config.StateDump":       "A geth dump style state export used as the base alloc of genesis.",
+	"Predeploy.Name":         "Contract name, which selects the contract in artifacts with several contracts.",
+	"Predeploy.Artifact":     "Hardhat, foundry or solc json artifact the runtime bytecode is read from.",
+	"Predeploy.Code":         "Hex runtime bytecode, exclusive with Artifact.",
+	"Predeploy.Address":      "Address of the contract.",
+	"Predeploy.Balance":      "Balance of the contract, a decimal or 0x prefixed hex integer in wei.",
+	"Predeploy.Storage":      "Initial storage of the contract, hex slot to hex value.",
+	"StateDump.Path":         "Path of the dump, files end with .jsonl are read as the iterative dump format.",
+	"StateDump.Include":      "Keep only the listed accounts if not empty.",
+	"StateDump.Exclude":      "Drop the listed accounts.",
+	"StateDump.Balance":      "Rewrite the balance of all dumped accounts if set.",
+	"StateDump.Balances":     "Rewrite the balance of single accounts, address to balance.",
+}
+
+// fieldPatterns restricts string fields, and the items or values of lists and maps of strings.
+var fieldPatterns = map[string]string{
+	"Config.InitBalance":     balancePattern,
+	"Config.OperatorAddress": optionalAddressPattern,
+	"Predeploy.Address":      addressPattern,
+	"Predeploy.Balance":      optionalBalancePattern,
+	"StateDump.Include":      addressPattern,
+	"StateDump.Exclude":      addressPattern,
+	"StateDump.Balance":      optionalBalancePattern,
+	"StateDump.Balances":     balancePattern,
+}
+
+// Schema generates the json schema of the config from the `Config` struct, the named environments
+// share the schema of the top level fields.
+func Schema() map[string]interface{} {
+	definitions := make(map[string]interface{})
+	root := typeSchema(reflect.TypeOf(Config{}), "", definitions)
+	definitions["Config"] = root
+
+	properties := make(map[string]interface{})
+	for k, v := range root["properties"].(map[string]interface{}) {
+		properties[k] = v
+	}
+	properties[SchemaKey] = map[string]interface{}{"type": "string"}
+	properties[EnvironmentsKey] = map[string]interface{}{
+		"description":          "Named environments selected by the -env flag, the fields of each one override the top level fields.",
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"$ref": "#/definitions/Config"},
+	}
+
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"title":                "zion-makeup config",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+		"definitions":          definitions,
+	}
+}
+
+// SchemaJson returns the indented json schema of the config.
+func SchemaJson() ([]byte, error) {
+	enc, err := json.MarshalIndent(Schema(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(enc, '\n'), nil
+}
+
+func typeSchema(typ reflect.Type, key string, definitions map[string]interface{}) map[string]interface{} {
+	s := make(map[string]interface{})
+	switch typ.Kind() {
+	case reflect.Ptr:
+		return typeSchema(typ.Elem(), key, definitions)
+	case reflect.String:
+		s["type"] = "string"
+		if pattern, ok := fieldPatterns[key]; ok {
+			s["pattern"] = pattern
+		}
+	case reflect.Int:
+		s["type"] = "integer"
+	case reflect.Uint64:
+		s["type"] = "integer"
+		s["minimum"] = 1
+	case reflect.Slice:
+		s["type"] = "array"
+		s["items"] = typeSchema(typ.Elem(), key, definitions)
+	case reflect.Map:
+		s["type"] = "object"
+		s["additionalProperties"] = typeSchema(typ.Elem(), key, definitions)
+	case reflect.Struct:
+		if typ != reflect.TypeOf(Config{}) {
+			if _, ok := definitions[typ.Name()]; !ok {
+				// placeholder against recursion, replaced once the struct generated
+				definitions[typ.Name()] = nil
+				definitions[typ.Name()] = structSchema(typ, definitions)
+			}
+			s["$ref"] = "#/definitions/" + typ.Name()
+			return s
+		}
+		return structSchema(typ, definitions)
+	default:
+		panic(fmt.Sprintf("config field %s of unsupported kind %s", key, typ.Kind()))
+	}
+	return s
+}
+
+func structSchema(typ reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		key := typ.Name() + "." + f.Name
+		prop := typeSchema(f.Type, key, definitions)
+		if doc, ok := fieldDocs[key]; ok {
+			prop["description"] = doc
+		}
+		properties[f.Name] = prop
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
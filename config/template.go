@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"gopkg.in/yaml.v2"
+)
+
+// examples denotes the values of optional fields, which are commented out in the yaml config.
+var examples = map[string]interface{}{
+	"HostLabels": yaml.MapSlice{
+		{Key: "127.0.0.1", Value: yaml.MapSlice{{Key: "zone", Value: "a"}, {Key: "rack", Value: "r1"}}},
+	},
+	"Uid":             1000,
+	"Gid":             1000,
+	"OperatorKey":     "operator.key",
+	"OperatorAddress": "0x8c09d936a1b408d6e0afaa537ba4e06c4504a0ae",
+	"Predeploys": []yaml.MapSlice{{
+		{Key: "Name", Value: "Multicall"},
+		{Key: "Artifact", Value: "artifacts/contracts/Multicall.sol/Multicall.json"},
+		{Key: "Address", Value: "0xcA11bde05977b3631167028862bE2a173976CA11"},
+		{Key: "Balance", Value: "0"},
+		{Key: "Storage", Value: yaml.MapSlice{{Key: "0x0", Value: "0x1"}}},
+	}},
+	"StateDump": yaml.MapSlice{
+		{Key: "Path", Value: "dump.json"},
+		{Key: "Include", Value: []string{}},
+		{Key: "Exclude", Value: []string{}},
+		{Key: "Balance", Value: ""},
+		{Key: "Balances", Value: yaml.MapSlice{{Key: "0x8c09d936a1b408d6e0afaa537ba4e06c4504a0ae", Value: "1000000000000000000"}}},
+	},
+}
+
+var environmentsExample = yaml.MapSlice{{Key: EnvironmentsKey, Value: yaml.MapSlice{
+	{Key: "local", Value: yaml.MapSlice{{Key: "Nodes", Value: 4}}},
+	{Key: "devnet", Value: yaml.MapSlice{
+		{Key: "IpList", Value: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+		{Key: "ChainID", Value: 60802},
+	}},
+}}}
+
+// SchemaPath returns the path of the json schema written beside the json config.
+func SchemaPath(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".schema.json"
+}
+
+// DefaultYaml returns the default config in yaml, every field is described by a comment and the
+// optional ones are commented out with an example.
+func DefaultYaml() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("# zion-makeup config, keys must match the field names exactly and may be overridden by\n")
+	buf.WriteString("# environment variables ZION_MAKEUP_<FIELD> and command line flags.\n")
+
+	def := reflect.ValueOf(defaultConfig()).Elem()
+	for _, name := range Fields() {
+		buf.WriteString("\n")
+		writeComment(buf, fieldDocs["Config."+name])
+
+		value, commented := examples[name]
+		if !commented {
+			value = def.FieldByName(name).Interface()
+		}
+		enc, err := yaml.Marshal(yaml.MapSlice{{Key: name, Value: value}})
+		if err != nil {
+			return nil, err
+		}
+		if commented {
+			writeComment(buf, string(enc))
+		} else {
+			buf.Write(enc)
+		}
+	}
+
+	enc, err := yaml.Marshal(environmentsExample)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n# Named environments selected by the -env flag, the fields of each one override the fields above.\n")
+	writeComment(buf, string(enc))
+	return buf.Bytes(), nil
+}
+
+func writeComment(buf *bytes.Buffer, text string) {
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		fmt.Fprintf(buf, "# %s\n", line)
+	}
+}
+
+// DefaultJson returns the default config in json, which points to the json schema at schemaRef
+// for the description of fields. optional fields are left empty.
+func DefaultJson(schemaRef string) ([]byte, error) {
+	def := reflect.ValueOf(defaultConfig()).Elem()
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "{\n  %q: %q", SchemaKey, schemaRef)
+	for _, name := range Fields() {
+		v := def.FieldByName(name)
+		switch {
+		case v.Kind() == reflect.Ptr && v.IsNil():
+			continue
+		case v.Kind() == reflect.Map && v.IsNil():
+			v = reflect.MakeMap(v.Type())
+		case v.Kind() == reflect.Slice && v.IsNil():
+			v = reflect.MakeSlice(v.Type(), 0, 0)
+		}
+		enc, err := json.MarshalIndent(v.Interface(), "  ", "  ")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(buf, ",\n  %q: %s", name, enc)
+	}
+	buf.WriteString("\n}\n")
+	return buf.Bytes(), nil
+}
+
+// WriteDefault writes the default config to path in the format chosen by extension, a json config is
+// accompanied by its json schema. existing files are kept unless force is set.
+func WriteDefault(path string, force bool) error {
+	var (
+		outputs = make(map[string][]byte)
+		enc     []byte
+		err     error
+	)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		enc, err = DefaultYaml()
+	case ".json":
+		schema := SchemaPath(path)
+		if outputs[schema], err = SchemaJson(); err != nil {
+			return err
+		}
+		enc, err = DefaultJson("./" + filepath.Base(schema))
+	default:
+		return fmt.Errorf("unsupported config format %s, use .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return err
+	}
+	outputs[path] = enc
+
+	if !force {
+		for p := range outputs {
+			if _, err := os.Stat(p); err == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite it", p)
+			}
+		}
+	}
+	for p, data := range outputs {
+		if err := files.WriteFileAtomic(p, data, files.PublicFileMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Errors collects all problems of a config with their field paths, so that they are reported at once
+// in the order of paths.
+type Errors []string
+
+func (e Errors) Error() string {
+	return fmt.Sprintf("invalid config:\n\t%s", strings.Join(e, "\n\t"))
+}
+
+func (e *Errors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	sort.Strings(e)
+	return e
+}
+
+// checkUnknown reports the keys of the decoded value which match no field of typ, keys must match
+// the field names exactly, so that a key differing only in case is reported and not silently taken.
+func checkUnknown(errs *Errors, path string, v interface{}, typ reflect.Type) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		switch typ.Kind() {
+		case reflect.Struct:
+			keys := make([]string, 0, len(t))
+			for k := range t {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				field, ok := structField(typ, k)
+				if !ok {
+					errs.add(joinPath(path, k), "unknown field")
+					continue
+				}
+				checkUnknown(errs, joinPath(path, field.Name), t[k], field.Type)
+			}
+		case reflect.Map:
+			for k, val := range t {
+				checkUnknown(errs, fmt.Sprintf("%s[%s]", path, k), val, typ.Elem())
+			}
+		}
+	case []interface{}:
+		if typ.Kind() == reflect.Slice {
+			for i, val := range t {
+				checkUnknown(errs, fmt.Sprintf("%s[%d]", path, i), val, typ.Elem())
+			}
+		}
+	}
+}
+
+func structField(typ reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).Name == key {
+			return typ.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// parseBig parses a non-negative decimal or 0x prefixed hex integer, as geth does for genesis balances.
+func parseBig(s string) (*big.Int, bool) {
+	n, ok := new(big.Int), false
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, ok = n.SetString(s[2:], 16)
+	} else {
+		n, ok = n.SetString(s, 10)
+	}
+	if !ok || n.Sign() < 0 {
+		return nil, false
+	}
+	return n, true
+}
+
+func isHexAddress(s string) bool {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	_, err := hex.DecodeString(s)
+	return len(s) == 40 && err == nil
+}
+
+// isHex denotes whether s is a hex string with optional 0x prefix, odd length is allowed as
+// `common.HexToHash` does.
+func isHex(s string) bool {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func checkBalance(errs *Errors, path, value string, optional bool) {
+	if value == "" && optional {
+		return
+	}
+	if _, ok := parseBig(value); !ok {
+		errs.add(path, "invalid balance %q, expect a decimal or 0x prefixed hex integer", value)
+	}
+}
+
+func checkAddress(errs *Errors, path, value string) {
+	if !isHexAddress(value) {
+		errs.add(path, "invalid address %q", value)
+	}
+}
+
+// Validate checks the effective config and returns all problems at once, it should be called
+// after all overrides applied and before any key generated.
+func Validate() error {
+	errs := make(Errors, 0)
+	c := Conf
+
+	if len(c.IpList) == 0 {
+		errs.add("IpList", "at least one ip required")
+	}
+	ips := make(map[string]bool)
+	for i, ip := range c.IpList {
+		path := fmt.Sprintf("IpList[%d]", i)
+		if net.ParseIP(ip) == nil {
+			errs.add(path, "invalid ip %q", ip)
+		}
+		if ips[ip] {
+			errs.add(path, "duplicate ip %s", ip)
+		}
+		ips[ip] = true
+	}
+	if c.StartPort <= 0 || c.StartPort > 65535 {
+		errs.add("StartPort", "port %d out of range 1-65535", c.StartPort)
+	} else if last := c.StartPort + c.Nodes - 1; c.Nodes > 0 && last > 65535 {
+		// a host takes up to all nodes with labels or a single ip
+		errs.add("StartPort", "ports of %d nodes from %d end at %d, out of range 1-65535", c.Nodes, c.StartPort, last)
+	}
+	checkBalance(&errs, "InitBalance", c.InitBalance, false)
+	if c.ChainID == 0 {
+		errs.add("ChainID", "should be positive")
+	}
+	if c.Nodes <= 0 {
+		errs.add("Nodes", "should be positive, got %d", c.Nodes)
+	}
+
+	hosts := make([]string, 0, len(c.HostLabels))
+	for host := range c.HostLabels {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		if !ips[host] {
+			errs.add(fmt.Sprintf("HostLabels[%s]", host), "host not in IpList")
+		}
+	}
+
+	if c.FaultTolerance < 0 {
+		errs.add("FaultTolerance", "should not be negative, got %d", c.FaultTolerance)
+	}
+	if c.Uid != nil && *c.Uid < 0 {
+		errs.add("Uid", "should not be negative, got %d", *c.Uid)
+	}
+	if c.Gid != nil && *c.Gid < 0 {
+		errs.add("Gid", "should not be negative, got %d", *c.Gid)
+	}
+	if c.OperatorAddress != "" {
+		checkAddress(&errs, "OperatorAddress", c.OperatorAddress)
+	}
+
+	for i, p := range c.Predeploys {
+		path := fmt.Sprintf("Predeploys[%d]", i)
+		if p == nil {
+			errs.add(path, "empty predeploy")
+			continue
+		}
+		checkAddress(&errs, path+".Address", p.Address)
+		checkBalance(&errs, path+".Balance", p.Balance, true)
+		switch {
+		case p.Code == "" && p.Artifact == "":
+			errs.add(path, "either Artifact or Code required")
+		case p.Code != "" && p.Artifact != "":
+			errs.add(path, "Artifact and Code are exclusive")
+		case p.Artifact == "" && !isHex(p.Code):
+			errs.add(path+".Code", "invalid hex code")
+		}
+		for k, v := range p.Storage {
+			if !isHex(k) || !isHex(v) {
+				errs.add(fmt.Sprintf("%s.Storage[%s]", path, k), "invalid hex slot or value %q", v)
+			}
+		}
+	}
+
+	if d := c.StateDump; d != nil {
+		if d.Path == "" {
+			errs.add("StateDump.Path", "path required")
+		}
+		for i, v := range d.Include {
+			checkAddress(&errs, fmt.Sprintf("StateDump.Include[%d]", i), v)
+		}
+		for i, v := range d.Exclude {
+			checkAddress(&errs, fmt.Sprintf("StateDump.Exclude[%d]", i), v)
+		}
+		checkBalance(&errs, "StateDump.Balance", d.Balance, true)
+		for k, v := range d.Balances {
+			path := fmt.Sprintf("StateDump.Balances[%s]", k)
+			checkAddress(&errs, path, k)
+			checkBalance(&errs, path, v, false)
+		}
+	}
+
+	return errs.err()
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+)
+
+// FaultTolerance returns the max number of faulty validators f which a network of n validators
+// can tolerate, hotstuff requires n >= 3f+1.
+func FaultTolerance(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return (n - 1) / 3
+}
+
+// QuorumSize returns the number of votes needed to commit a block, which is ceil(2n/3) and
+// equals 2f+1 when n = 3f+1.
+func QuorumSize(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return (2*n + 2) / 3
+}
+
+// CheckFaultTolerance validates the validator count against the configured target fault tolerance
+// and the node to host placement before any key generated. sizes which waste a node are warned,
+// and a placement in which a single host failure halts the chain is refused.
+func CheckFaultTolerance(n int, placement []*Endpoint) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid number of validators %d", n)
+	}
+
+	f, quorum := FaultTolerance(n), QuorumSize(n)
+	log.Infof("%d validators tolerate %d faulty, quorum size %d", n, f, quorum)
+
+	target := config.Conf.FaultTolerance
+	if target < 0 {
+		return fmt.Errorf("invalid target fault tolerance %d", target)
+	}
+	if min := 3*target + 1; n < min {
+		return fmt.Errorf("%d validators can not tolerate %d faulty, at least %d needed", n, target, min)
+	}
+	if f == 0 {
+		warnf("%d validators can not tolerate any faulty validator, use at least 4", n)
+	}
+	if optimal := 3*f + 1; n > optimal {
+		warnf("%d validators tolerate the same %d faulty as %d, the extra %d only enlarge the quorum",
+			n, f, optimal, n-optimal)
+	}
+
+	hosts := nodesPerHost(placement)
+	if len(hosts) < 2 {
+		warnf("all validators are placed on a single host, which is a single point of failure")
+		return nil
+	}
+	for _, host := range config.Conf.IpList {
+		if count := hosts[host]; n-count < quorum {
+			return fmt.Errorf("host %s holds %d of %d validators, the remaining can not reach quorum %d "+
+				"and the chain halts if it fails", host, count, n, quorum)
+		}
+	}
+	return nil
+}
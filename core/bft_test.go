@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dylenfu/zion-makeup/config"
+)
+
+func TestCheckFaultTolerance(t *testing.T) {
+	conf := *config.Conf
+	defer func() { config.Conf = &conf }()
+
+	cases := []struct {
+		n      int
+		target int
+		hosts  int
+		err    string
+		warn   string
+	}{
+		{0, 0, 1, "invalid number of validators 0", ""},
+		{1, 0, 1, "", "can not tolerate any faulty"},
+		{2, 0, 1, "", "single host"},
+		{2, 0, 2, "host 10.0.0.1 holds 1 of 2 validators, the remaining can not reach quorum 2", ""},
+		{3, 1, 3, "3 validators can not tolerate 1 faulty, at least 4 needed", ""},
+		{4, -1, 4, "invalid target fault tolerance -1", ""},
+		{4, 1, 1, "", "single host"},
+		{4, 1, 2, "host 10.0.0.1 holds 2 of 4 validators, the remaining can not reach quorum 3", ""},
+		{4, 1, 4, "", ""},
+		{5, 1, 5, "", "the extra 1 only enlarge the quorum"},
+		{6, 1, 3, "", "the extra 2 only enlarge the quorum"},
+		{7, 2, 3, "host 10.0.0.1 holds 3 of 7 validators, the remaining can not reach quorum 5", ""},
+		{7, 2, 7, "", ""},
+		{7, 3, 7, "7 validators can not tolerate 3 faulty, at least 10 needed", ""},
+	}
+	for _, c := range cases {
+		config.Conf.FaultTolerance = c.target
+		config.Conf.IpList = make([]string, 0, c.hosts)
+		for i := 0; i < c.hosts; i++ {
+			config.Conf.IpList = append(config.Conf.IpList, fmt.Sprintf("10.0.0.%d", i+1))
+		}
+		resetWarnings()
+
+		name := fmt.Sprintf("n=%d f=%d hosts=%d", c.n, c.target, c.hosts)
+		err := CheckFaultTolerance(c.n, placeNodes(c.n))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expect err %q, got %v", name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected err %v", name, err)
+		}
+		got := strings.Join(warnings, "\n")
+		if c.warn == "" && got != "" || !strings.Contains(got, c.warn) {
+			t.Errorf("%s: expect warning %q, got %q", name, c.warn, got)
+		}
+	}
+}
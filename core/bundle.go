@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+)
+
+const (
+	bundleFolder   = "bundles"
+	bundleManifest = "MANIFEST.sha256"
+)
+
+// HostNode denotes a generated node together with the p2p endpoint it was assigned to.
+type HostNode struct {
+	Index int
+	Host  string
+	Port  int
+	Node  *Node
+}
+
+// Bundle groups the nodes of an existing network by host and writes one archive per host
+// under `build/<env>/bundles`, e.g. `bundles/10.0.0.1.tar.gz`.
+func Bundle(dir string) error {
+	env = path.Join(folder, dir)
+
+	list, err := loadNetwork(env)
+	if err != nil {
+		return err
+	}
+	if err := writeBundles(env, list); err != nil {
+		return err
+	}
+	return applyOwnership(env)
+}
+
+func writeBundles(dir string, list []*HostNode) error {
+	hosts := groupByHost(list)
+	if err := os.MkdirAll(path.Join(dir, bundleFolder), files.SecretDirMode); err != nil {
+		return err
+	}
+	for _, host := range sortedHosts(hosts) {
+		dst := path.Join(dir, bundleFolder, host+".tar.gz")
+		if err := writeHostBundle(dir, dst, host, hosts[host]); err != nil {
+			return fmt.Errorf("bundle host %s failed, err: %v", host, err)
+		}
+		log.Infof("bundle %s with %d nodes saved to %s", host, len(hosts[host]), dst)
+	}
+	return nil
+}
+
+func groupByHost(list []*HostNode) map[string][]*HostNode {
+	hosts := make(map[string][]*HostNode)
+	for _, v := range list {
+		hosts[v.Host] = append(hosts[v.Host], v)
+	}
+	return hosts
+}
+
+func sortedHosts(hosts map[string][]*HostNode) []string {
+	list := make([]string, 0, len(hosts))
+	for host := range hosts {
+		list = append(list, host)
+	}
+	sort.Strings(list)
+	return list
+}
+
+type bundleFile struct {
+	name string
+	data []byte
+	mode int64
+}
+
+func writeHostBundle(dir, dst, host string, nodes []*HostNode) error {
+	list := make([]*bundleFile, 0)
+	for _, name := range []string{"genesis.json", "static-nodes.json"} {
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		list = append(list, &bundleFile{name: name, data: data, mode: int64(files.PublicFileMode)})
+	}
+
+	for _, v := range nodes {
+		nodeDir := path.Join("nodes", fmt.Sprintf("node%d", v.Index))
+		nodekey, err := ioutil.ReadFile(path.Join(dir, nodeDir, "nodekey"))
+		if err != nil {
+			return err
+		}
+		pubkey, err := ioutil.ReadFile(path.Join(dir, nodeDir, "pubkey"))
+		if err != nil {
+			return err
+		}
+		script := launchScriptTemplate(v, v.Node.Address.Hex())
+
+		list = append(list,
+			&bundleFile{name: path.Join(nodeDir, "nodekey"), data: nodekey, mode: int64(files.SecretFileMode)},
+			&bundleFile{name: path.Join(nodeDir, "pubkey"), data: pubkey, mode: int64(files.PublicFileMode)},
+			&bundleFile{name: path.Join(nodeDir, "start.sh"), data: []byte(script), mode: 0755},
+		)
+	}
+
+	manifest := ""
+	for _, v := range list {
+		sum := sha256.Sum256(v.data)
+		manifest += fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), v.name)
+	}
+	list = append(list, &bundleFile{name: bundleManifest, data: []byte(manifest), mode: int64(files.PublicFileMode)})
+
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	for _, v := range list {
+		hdr := &tar.Header{
+			Name:    path.Join(host, v.name),
+			Mode:    v.mode,
+			Size:    int64(len(v.data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(v.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	// archive contains node keys
+	return files.WriteFileAtomic(dst, buf.Bytes(), files.SecretFileMode)
+}
+
+// launchScriptTemplate generate the script which initialize and start a node in the unpacked bundle,
+// the zion binary can be specified with env `GETH`.
+func launchScriptTemplate(node *HostNode, miner string) string {
+	return fmt.Sprintf(`#!/bin/bash
+# start node%d on %s:%d
+set -e
+
+GETH=${GETH:-geth}
+NODE_DIR=$(cd "$(dirname "$0")" && pwd)
+ROOT_DIR=$(cd "$NODE_DIR/../.." && pwd)
+DATA_DIR=$NODE_DIR/data
+
+if [ ! -d "$DATA_DIR/geth/chaindata" ]; then
+    $GETH init --datadir "$DATA_DIR" "$ROOT_DIR/genesis.json"
+fi
+cp "$ROOT_DIR/static-nodes.json" "$DATA_DIR/geth/static-nodes.json"
+
+exec $GETH --datadir "$DATA_DIR" \
+    --nodekey "$NODE_DIR/nodekey" \
+    --port %d \
+    --networkid %d \
+    --syncmode full \
+    --mine --miner.etherbase %s \
+    "$@"
+`, node.Index, node.Host, node.Port, node.Port, config.Conf.ChainID, miner)
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// extractBundle unpacks the archive into dir with the modes of its entries, and returns the names
+// of the entries in order.
+func extractBundle(t *testing.T, archive, dir string) []string {
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+
+	names := make([]string, 0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data, os.FileMode(hdr.Mode)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, os.FileMode(hdr.Mode)); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBundle(t *testing.T) {
+	generateTestNetwork(t, 4)
+	if err := Bundle("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "zion-makeup-bundle-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	names := extractBundle(t, filepath.Join(env, bundleFolder, localHost+".tar.gz"), dir)
+
+	expect := []string{bundleManifest, "genesis.json", "static-nodes.json"}
+	for i := 0; i < 4; i++ {
+		for _, name := range []string{"nodekey", "pubkey", "start.sh"} {
+			expect = append(expect, fmt.Sprintf("nodes/node%d/%s", i, name))
+		}
+	}
+	for i := range expect {
+		expect[i] = localHost + "/" + expect[i]
+	}
+	sort.Strings(expect)
+	if strings.Join(names, " ") != strings.Join(expect, " ") {
+		t.Fatalf("bundle files %v, expect %v", names, expect)
+	}
+
+	root := filepath.Join(dir, localHost)
+	for i := 0; i < 4; i++ {
+		nodeDir := filepath.Join(root, "nodes", fmt.Sprintf("node%d", i))
+		if info, err := os.Stat(filepath.Join(nodeDir, "nodekey")); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("node%d: nodekey mode %v, err %v, expect 0600", i, info.Mode(), err)
+		}
+		if info, err := os.Stat(filepath.Join(nodeDir, "start.sh")); err != nil || info.Mode().Perm()&0111 == 0 {
+			t.Errorf("node%d: start.sh mode %v, err %v, expect executable", i, info.Mode(), err)
+		}
+	}
+
+	// every file but the manifest itself is listed with its checksum
+	manifest, err := ioutil.ReadFile(filepath.Join(root, bundleManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(manifest)), "\n")
+	if len(lines) != len(expect)-1 {
+		t.Fatalf("%s lists %d files, expect %d", bundleManifest, len(lines), len(expect)-1)
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("invalid line %q in %s", line, bundleManifest)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(fields[1])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != fields[0] {
+			t.Errorf("%s does not match its checksum in %s", fields[1], bundleManifest)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/dylenfu/zion-makeup/pkg/supervisor"
+	"github.com/ethereum/go-ethereum/rpc"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ChaosKill      = "kill"
+	ChaosPause     = "pause"
+	ChaosPartition = "partition"
+
+	defaultRecoverBlocks  = 3
+	defaultRecoverTimeout = 2 * time.Minute
+)
+
+// ChaosDuration is a duration written as `10s` or `1m30s` in scenario files.
+type ChaosDuration time.Duration
+
+func (d *ChaosDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ChaosDuration(v)
+	return nil
+}
+
+// ChaosStep denotes a fault injected At the offset from the start of the scenario and reverted
+// after Duration. kill and pause act on Nodes, partition splits the network into Groups.
+type ChaosStep struct {
+	At       ChaosDuration `yaml:"at"`
+	Action   string        `yaml:"action"`
+	Nodes    []int         `yaml:"nodes"`
+	Groups   [][]int       `yaml:"groups"`
+	Duration ChaosDuration `yaml:"duration"`
+}
+
+// ChaosRecover denotes how many new blocks are expected within Timeout after the last step.
+type ChaosRecover struct {
+	Blocks  uint64        `yaml:"blocks"`
+	Timeout ChaosDuration `yaml:"timeout"`
+}
+
+// ChaosScenario denotes the schedule of faults injected into a locally launched network.
+type ChaosScenario struct {
+	Name    string       `yaml:"name"`
+	Steps   []*ChaosStep `yaml:"steps"`
+	Recover ChaosRecover `yaml:"recover"`
+}
+
+// LoadChaosScenario reads the scenario file and checks it against a network of n validators.
+func LoadChaosScenario(file string, n int) (*ChaosScenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := new(ChaosScenario)
+	if err := yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, fmt.Errorf("parse scenario %s failed, err: %v", file, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(path.Base(file), path.Ext(file))
+	}
+	if s.Recover.Blocks == 0 {
+		s.Recover.Blocks = defaultRecoverBlocks
+	}
+	if s.Recover.Timeout == 0 {
+		s.Recover.Timeout = ChaosDuration(defaultRecoverTimeout)
+	}
+	if err := s.validate(n); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s, err: %v", file, err)
+	}
+	return s, nil
+}
+
+func (st *ChaosStep) end() time.Duration {
+	return time.Duration(st.At) + time.Duration(st.Duration)
+}
+
+// faulty returns the nodes which do not take part in consensus during the step, for a partition
+// these are the nodes outside the largest group.
+func (st *ChaosStep) faulty() []int {
+	if st.Action != ChaosPartition {
+		return st.Nodes
+	}
+	largest := 0
+	for i, g := range st.Groups {
+		if len(g) > len(st.Groups[largest]) {
+			largest = i
+		}
+	}
+	list := make([]int, 0)
+	for i, g := range st.Groups {
+		if i != largest {
+			list = append(list, g...)
+		}
+	}
+	return list
+}
+
+func checkIndexes(list []int, n int, seen map[int]bool) error {
+	for _, v := range list {
+		if v < 0 || v >= n {
+			return fmt.Errorf("node%d out of range [0, %d)", v, n)
+		}
+		if seen[v] {
+			return fmt.Errorf("node%d listed twice", v)
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+// validate checks the steps, and that no more than f validators are faulty at any moment so that
+// the network keeps a quorum.
+func (s *ChaosScenario) validate(n int) error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	for i, st := range s.Steps {
+		if st.At < 0 || st.Duration <= 0 {
+			return fmt.Errorf("step %d: at must be non-negative and duration positive", i)
+		}
+		switch st.Action {
+		case ChaosKill, ChaosPause:
+			if len(st.Nodes) == 0 || len(st.Groups) > 0 {
+				return fmt.Errorf("step %d: %s requires nodes but no groups", i, st.Action)
+			}
+			if err := checkIndexes(st.Nodes, n, make(map[int]bool)); err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+		case ChaosPartition:
+			if len(st.Groups) < 2 || len(st.Nodes) > 0 {
+				return fmt.Errorf("step %d: partition requires at least 2 groups but no nodes", i)
+			}
+			seen := make(map[int]bool)
+			for _, g := range st.Groups {
+				if err := checkIndexes(g, n, seen); err != nil {
+					return fmt.Errorf("step %d: %v", i, err)
+				}
+			}
+			if len(seen) != n {
+				return fmt.Errorf("step %d: groups cover %d of %d nodes", i, len(seen), n)
+			}
+		default:
+			return fmt.Errorf("step %d: unknown action %q, expect %s, %s or %s", i, st.Action, ChaosKill, ChaosPause, ChaosPartition)
+		}
+	}
+
+	// the number of faulty nodes only grows when a step starts
+	f := FaultTolerance(n)
+	for i, st := range s.Steps {
+		at := time.Duration(st.At)
+		faulty := make(map[int]bool)
+		partitions, pauses := 0, 0
+		for _, other := range s.Steps {
+			if time.Duration(other.At) > at || other.end() <= at {
+				continue
+			}
+			switch other.Action {
+			case ChaosPartition:
+				partitions++
+			case ChaosPause:
+				pauses++
+			}
+			for _, v := range other.faulty() {
+				faulty[v] = true
+			}
+		}
+		if partitions > 1 {
+			return fmt.Errorf("step %d: overlaps another partition", i)
+		}
+		// a paused node can not drop or add peers when the partition starts or heals
+		if partitions > 0 && pauses > 0 {
+			return fmt.Errorf("step %d: a pause overlaps a partition", i)
+		}
+		if len(faulty) > f {
+			return fmt.Errorf("step %d: %d nodes faulty at %s, %d validators tolerate %d", i, len(faulty), at, n, f)
+		}
+	}
+	return nil
+}
+
+// checkLaunch checks that the launch supports the faults of the scenario, the supervisor must
+// restart every killed node, a kill counts as one restart of the node against the limit of `up`,
+// and partitions need the admin api of the nodes.
+func (s *ChaosScenario) checkLaunch(launch *Launch) error {
+	kills := make(map[int]int)
+	for _, st := range s.Steps {
+		if st.Action == ChaosPartition && !launch.Admin {
+			return fmt.Errorf("%s needs the admin api of the nodes, run `up` with -admin", st.Action)
+		}
+		if st.Action != ChaosKill {
+			continue
+		}
+		if launch.Restart == supervisor.RestartNever {
+			return fmt.Errorf("%s needs nodes restarted, run `up` with a restart policy other than %q", st.Action, supervisor.RestartNever)
+		}
+		for _, v := range st.Nodes {
+			kills[v]++
+		}
+	}
+	for v, n := range kills {
+		if launch.MaxRestarts > 0 && n > launch.MaxRestarts {
+			return fmt.Errorf("node%d killed %d times, `up` restarts it at most %d times", v, n, launch.MaxRestarts)
+		}
+	}
+	return nil
+}
+
+type chaosEvent struct {
+	Offset time.Duration
+	Text   string
+}
+
+type chaosRun struct {
+	launch  *Launch
+	list    []*HostNode
+	nodes   map[int]*LaunchNode
+	clients map[int]*rpc.Client
+	start   time.Time
+
+	mu       sync.Mutex
+	timeline []*chaosEvent
+}
+
+func (r *chaosRun) event(format string, args ...interface{}) {
+	e := &chaosEvent{Offset: time.Since(r.start).Truncate(time.Millisecond), Text: fmt.Sprintf(format, args...)}
+	log.Infof("chaos +%s %s", e.Offset, e.Text)
+	r.mu.Lock()
+	r.timeline = append(r.timeline, e)
+	r.mu.Unlock()
+}
+
+func (r *chaosRun) signal(index int, sig syscall.Signal) error {
+	node := r.nodes[index]
+	pid, ok, err := supervisor.ReadPid(node.PidFile)
+	if err != nil {
+		return fmt.Errorf("node%d: %v", index, err)
+	}
+	if !ok {
+		return fmt.Errorf("node%d is not running", index)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// enode returns the static url of the node at the loopback address.
+func (r *chaosRun) enode(index int) string {
+	for _, v := range r.list {
+		if v.Index == index {
+			return NodeStaticInfoTemp(v.Node.ID(), localHost, v.Port)
+		}
+	}
+	return ""
+}
+
+// link adds or removes the peers between the groups on every running node through the admin api,
+// both sides drop the static peer so that neither dials the other again. nodes down at the moment
+// read the static peers written for them when restarted.
+func (r *chaosRun) link(groups [][]int, connect bool) error {
+	method := "admin_removePeer"
+	if connect {
+		method = "admin_addPeer"
+	}
+	for i, g := range groups {
+		for _, v := range g {
+			if _, ok, _ := supervisor.ReadPid(r.nodes[v].PidFile); !ok {
+				continue
+			}
+			for j, other := range groups {
+				if j == i {
+					continue
+				}
+				for _, peer := range other {
+					var done bool
+					ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+					err := r.clients[v].CallContext(ctx, &done, method, r.enode(peer))
+					cancel()
+					if err != nil {
+						return fmt.Errorf("node%d %s node%d failed, err: %v", v, method, peer, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *chaosRun) apply(st *ChaosStep) error {
+	switch st.Action {
+	case ChaosKill:
+		for _, v := range st.Nodes {
+			if err := files.WriteFileAtomic(r.nodes[v].Hold, []byte("chaos\n"), files.PublicFileMode); err != nil {
+				return err
+			}
+			if err := r.signal(v, syscall.SIGKILL); err != nil {
+				return err
+			}
+		}
+		r.event("killed %s for %s", nodeNames(st.Nodes), time.Duration(st.Duration))
+	case ChaosPause:
+		for _, v := range st.Nodes {
+			if err := r.signal(v, syscall.SIGSTOP); err != nil {
+				return err
+			}
+		}
+		r.event("paused %s for %s", nodeNames(st.Nodes), time.Duration(st.Duration))
+	case ChaosPartition:
+		for _, g := range st.Groups {
+			group := make(map[int]bool)
+			for _, v := range g {
+				group[v] = true
+			}
+			for _, v := range g {
+				if err := writeStaticPeers(r.nodes[v], r.list, group); err != nil {
+					return err
+				}
+			}
+		}
+		if err := r.link(st.Groups, false); err != nil {
+			return err
+		}
+		groups := make([]string, 0, len(st.Groups))
+		for _, g := range st.Groups {
+			groups = append(groups, "["+nodeNames(g)+"]")
+		}
+		r.event("partitioned into %s for %s", strings.Join(groups, " "), time.Duration(st.Duration))
+	}
+	return nil
+}
+
+func (r *chaosRun) revert(st *ChaosStep) error {
+	switch st.Action {
+	case ChaosKill:
+		for _, v := range st.Nodes {
+			if err := os.Remove(r.nodes[v].Hold); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		r.event("released %s to restart", nodeNames(st.Nodes))
+	case ChaosPause:
+		for _, v := range st.Nodes {
+			if err := r.signal(v, syscall.SIGCONT); err != nil {
+				return err
+			}
+		}
+		r.event("resumed %s", nodeNames(st.Nodes))
+	case ChaosPartition:
+		for _, v := range r.launch.Nodes {
+			if err := writeStaticPeers(v, r.list, nil); err != nil {
+				return err
+			}
+		}
+		if err := r.link(st.Groups, true); err != nil {
+			return err
+		}
+		r.event("healed partition")
+	}
+	return nil
+}
+
+// step injects the fault at its offset and reverts it after the duration, a fault is reverted at
+// once if ctx is done so that no node is left down.
+func (r *chaosRun) step(ctx context.Context, st *ChaosStep) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-time.After(time.Until(r.start.Add(time.Duration(st.At)))):
+	}
+	if err := r.apply(st); err != nil {
+		r.revert(st)
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Until(r.start.Add(st.end()))):
+	}
+	return r.revert(st)
+}
+
+func nodeNames(list []int) string {
+	names := make([]string, 0, len(list))
+	for _, v := range list {
+		names = append(names, fmt.Sprintf("node%d", v))
+	}
+	return strings.Join(names, ", ")
+}
+
+func printTimeline(w io.Writer, name string, timeline []*chaosEvent) {
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].Offset < timeline[j].Offset })
+	fmt.Fprintf(w, "chaos scenario %s:\n", name)
+	for _, e := range timeline {
+		fmt.Fprintf(w, "  +%-10s %s\n", e.Offset, e.Text)
+	}
+}
+
+// Chaos runs the scenario against the network launched by `up` in the environment, then checks
+// that block production resumes, and prints the timeline of the faults.
+func Chaos(dir, file string, interval time.Duration) error {
+	env = path.Join(folder, dir)
+	launch, err := loadLaunch(env)
+	if err != nil {
+		return err
+	}
+	if _, ok, err := supervisor.ReadPid(runPath(env, upPidFile)); err != nil || !ok {
+		return fmt.Errorf("network in %s is not up, run `up` first", env)
+	}
+	list, err := loadNetwork(env)
+	if err != nil {
+		return err
+	}
+	scenario, err := LoadChaosScenario(file, len(list))
+	if err != nil {
+		return err
+	}
+	if err := scenario.checkLaunch(launch); err != nil {
+		return err
+	}
+	targets, err := statusTargets(env, &StatusOptions{})
+	if err != nil {
+		return err
+	}
+
+	r := &chaosRun{launch: launch, list: list, nodes: make(map[int]*LaunchNode), clients: make(map[int]*rpc.Client), start: time.Now()}
+	for _, v := range launch.Nodes {
+		client, err := rpc.DialHTTP(v.RPC)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		r.nodes[v.Index] = v
+		r.clients[v.Index] = client
+	}
+	r.event("start scenario %s with %d steps, height %d", scenario.Name, len(scenario.Steps), maxHeight(targets))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Warnf("%s received, revert all faults", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	errs := make([]string, 0)
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for i, st := range scenario.Steps {
+		wg.Add(1)
+		go func(i int, st *ChaosStep) {
+			defer wg.Done()
+			if err := r.step(ctx, st); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("step %d: %v", i, err))
+				mu.Unlock()
+			}
+		}(i, st)
+	}
+	wg.Wait()
+	if len(errs) > 0 || ctx.Err() != nil {
+		printTimeline(os.Stdout, scenario.Name, r.timeline)
+		if len(errs) == 0 {
+			return fmt.Errorf("chaos scenario %s interrupted", scenario.Name)
+		}
+		return fmt.Errorf("chaos scenario %s failed:\n\t%s", scenario.Name, strings.Join(errs, "\n\t"))
+	}
+
+	height := maxHeight(targets) + scenario.Recover.Blocks
+	r.event("all faults reverted, wait for height %d", height)
+	err = waitReady(ioutil.Discard, targets, height, time.Duration(scenario.Recover.Timeout), interval)
+	if err == nil {
+		r.event("block production resumed at height %d", maxHeight(targets))
+	} else {
+		r.event("block production not resumed")
+	}
+	printTimeline(os.Stdout, scenario.Name, r.timeline)
+	return err
+}
+
+// maxHeight returns the highest block among the reachable nodes.
+func maxHeight(targets []*statusTarget) uint64 {
+	var height uint64
+	for _, s := range queryStatus(context.Background(), targets) {
+		if s.Err == nil && s.Height > height {
+			height = s.Height
+		}
+	}
+	return height
+}
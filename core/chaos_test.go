@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/pkg/supervisor"
+)
+
+func TestLoadChaosScenario(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zion-makeup-chaos-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		yaml string
+		err  string
+	}{
+		{`
+steps:
+  - {at: 1s, action: kill, nodes: [1], duration: 5s}
+  - {at: 6s, action: pause, nodes: [2], duration: 5s}
+  - {at: 12s, action: partition, groups: [[0, 1, 2], [3]], duration: 5s}
+`, ""},
+		{`
+steps:
+  - {at: 1s, action: kill, nodes: [1], duration: 5s}
+  - {at: 3s, action: pause, nodes: [2], duration: 5s}
+`, "step 1: 2 nodes faulty at 3s, 4 validators tolerate 1"},
+		{`
+steps:
+  - {at: 1s, action: partition, groups: [[0, 1], [2, 3]], duration: 5s}
+`, "step 0: 2 nodes faulty"},
+		{`
+steps:
+  - {at: 1s, action: partition, groups: [[0, 1, 2], [3]], duration: 5s}
+  - {at: 3s, action: pause, nodes: [3], duration: 5s}
+`, "step 1: a pause overlaps a partition"},
+		{`
+steps:
+  - {at: 1s, action: partition, groups: [[0, 1, 2]], duration: 5s}
+`, "partition requires at least 2 groups"},
+		{`
+steps:
+  - {at: 1s, action: partition, groups: [[0, 1], [2]], duration: 5s}
+`, "groups cover 3 of 4 nodes"},
+		{`
+steps:
+  - {at: 1s, action: kill, nodes: [4], duration: 5s}
+`, "node4 out of range"},
+		{`
+steps:
+  - {at: 1s, action: crash, nodes: [1], duration: 5s}
+`, `unknown action "crash"`},
+		{`
+steps:
+  - {at: 1s, action: kill, nodes: [1]}
+`, "duration positive"},
+		{`
+steps:
+  - {at: 1s, action: kill, node: [1], duration: 5s}
+`, "field node not found"},
+	}
+	for i, c := range cases {
+		file := path.Join(dir, "scenario.yaml")
+		if err := ioutil.WriteFile(file, []byte(c.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := LoadChaosScenario(file, 4)
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("case %d: unexpected err %v", i, err)
+				continue
+			}
+			if s.Name != "scenario" || s.Recover.Blocks != defaultRecoverBlocks || time.Duration(s.Recover.Timeout) != defaultRecoverTimeout {
+				t.Errorf("case %d: unexpected defaults %+v", i, s)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("case %d: expect err %q, got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestChaosCheckLaunch(t *testing.T) {
+	s := &ChaosScenario{Steps: []*ChaosStep{
+		{Action: ChaosKill, Nodes: []int{1}},
+		{Action: ChaosPartition, Groups: [][]int{{0, 1, 2}, {3}}},
+		{Action: ChaosKill, Nodes: []int{1, 2}},
+	}}
+	cases := []struct {
+		launch *Launch
+		err    string
+	}{
+		{&Launch{Restart: supervisor.RestartAlways, MaxRestarts: 2, Admin: true}, ""},
+		{&Launch{Restart: supervisor.RestartAlways, Admin: true}, ""},
+		{&Launch{Restart: supervisor.RestartAlways, MaxRestarts: 1, Admin: true}, "node1 killed 2 times, `up` restarts it at most 1 times"},
+		{&Launch{Restart: supervisor.RestartNever, Admin: true}, "kill needs nodes restarted"},
+		{&Launch{Restart: supervisor.RestartAlways}, "partition needs the admin api of the nodes"},
+	}
+	for i, c := range cases {
+		err := s.checkLaunch(c.launch)
+		if c.err == "" && err != nil {
+			t.Errorf("case %d: unexpected err %v", i, err)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("case %d: expect err %q, got %v", i, c.err, err)
+		}
+	}
+}
@@ -19,15 +19,18 @@
 package core
 
 import (
+	"crypto/ecdsa"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"math/big"
 	"os"
 	"path"
 
 	"github.com/dylenfu/zion-makeup/config"
 	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -40,27 +43,83 @@ const (
 
 var env string
 
-func Run(dir string, n int, initAllocBalance string) {
+// keySource provides the entropy of node keys, tests replace it with a seeded source to generate
+// deterministic networks.
+var keySource io.Reader = rand.Reader
+
+// Run generate a new network in `build/<dir>`. files are written to a staging directory first and
+// moved into place after all of them generated, an existing network is handled by the policy.
+func Run(dir string, n int, initAllocBalance string, policy ExistPolicy) error {
+	resetWarnings()
+	target := path.Join(folder, dir)
+	if err := checkExistingNetwork(target, policy); err != nil {
+		return err
+	}
+
+	placement := placeNodes(n)
+	if err := CheckFaultTolerance(n, placement); err != nil {
+		return err
+	}
+	checkFailureDomains(hostNodesOf(placement))
+
 	log.Infof("generate %d nodes", n)
 
-	os.MkdirAll(folder, os.ModePerm)
-	env = path.Join(folder, dir)
+	staging, err := newStaging(target)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	env = staging
 
-	nodes := generateNodes(n)
+	nodes, err := generateNodes(n)
+	if err != nil {
+		return err
+	}
 	sortedNodes := SortNodes(nodes)
-	saveNodes(sortedNodes)
+	if err := saveNodes(sortedNodes); err != nil {
+		return err
+	}
 	//saveAlloc(sortedNodes, initAllocBalance)
 	//saveMinerList(sortedNodes)
 	//generateExtra(sortedNodes)
-	saveGenesis(sortedNodes, initAllocBalance)
-	generateStaticNodesFile(sortedNodes)
+	genesis, err := saveGenesis(sortedNodes, initAllocBalance)
+	if err != nil {
+		return err
+	}
+	if err := generateStaticNodesFile(sortedNodes); err != nil {
+		return err
+	}
+	if err := saveManifest(env, genesis); err != nil {
+		return err
+	}
+
+	if err := commitNetwork(staging, target, policy); err != nil {
+		return err
+	}
+	return applyOwnership(target)
+}
+
+// generateKey reads a private key from keySource, seeds out of the curve order are skipped.
+func generateKey() (*ecdsa.PrivateKey, error) {
+	seed := make([]byte, 32)
+	for {
+		if _, err := io.ReadFull(keySource, seed); err != nil {
+			return nil, err
+		}
+		if key, err := crypto.ToECDSA(seed); err == nil {
+			return key, nil
+		}
+	}
 }
 
-func generateNodes(n int) []*Node {
+func generateNodes(n int) ([]*Node, error) {
 	nodes := make([]*Node, 0)
 
 	for i := 0; i < n; i++ {
-		key, _ := crypto.GenerateKey()
+		key, err := generateKey()
+		if err != nil {
+			return nil, err
+		}
 		addr := crypto.PubkeyToAddress(key.PublicKey)
 
 		node := &Node{
@@ -71,22 +130,35 @@ func generateNodes(n int) []*Node {
 		nodes = append(nodes, node)
 	}
 
-	return nodes
+	return nodes, nil
 }
 
-func saveNodes(sortedNodes []*Node) {
-	os.MkdirAll(path.Join(env, "nodes"), os.ModePerm)
+func saveNodes(sortedNodes []*Node) error {
+	if err := os.MkdirAll(path.Join(env, "nodes"), files.PublicDirMode); err != nil {
+		return err
+	}
 
 	for i, v := range sortedNodes {
-		sNodeIndex := fmt.Sprintf("node%d", i)
-		nodeDir := path.Join(env, "nodes", sNodeIndex)
-		os.MkdirAll(nodeDir, os.ModePerm)
-		os.WriteFile(path.Join(nodeDir, "nodekey"), []byte(v.NodeKeyHex(false)), os.ModePerm)
-		os.WriteFile(path.Join(nodeDir, "pubkey"), []byte(v.PubKeyHex()), os.ModePerm)
+		if err := saveNode(i, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveNode(index int, v *Node) error {
+	sNodeIndex := fmt.Sprintf("node%d", index)
+	nodeDir := path.Join(env, "nodes", sNodeIndex)
+	if err := os.MkdirAll(nodeDir, files.SecretDirMode); err != nil {
+		return err
+	}
+	if err := files.WriteFileAtomic(path.Join(nodeDir, "nodekey"), []byte(v.NodeKeyHex(false)), files.SecretFileMode); err != nil {
+		return err
 	}
+	return files.WriteFileAtomic(path.Join(nodeDir, "pubkey"), []byte(v.PubKeyHex()), files.PublicFileMode)
 }
 
-func generateExtra(sortedNodes []*Node) {
+func generateExtra(sortedNodes []*Node) error {
 	list := make([]common.Address, 0)
 	for _, v := range sortedNodes {
 		list = append(list, v.Address)
@@ -94,16 +166,17 @@ func generateExtra(sortedNodes []*Node) {
 
 	extra, err := Encode(list)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	if err := ioutil.WriteFile(path.Join(env, "extra.dat"), []byte(extra), os.ModePerm); err != nil {
-		panic(err)
+	if err := files.WriteFileAtomic(path.Join(env, "extra.dat"), []byte(extra), files.PublicFileMode); err != nil {
+		return err
 	}
 	log.Infof("genesis extra %s", extra)
+	return nil
 }
 
-func saveMinerList(sortedNodes []*Node) {
+func saveMinerList(sortedNodes []*Node) error {
 	minerlistTxt := "miners=("
 	for i, v := range sortedNodes {
 		minerlistTxt += v.Address.Hex()
@@ -113,38 +186,42 @@ func saveMinerList(sortedNodes []*Node) {
 	}
 	minerlistTxt += ")"
 
-	if err := ioutil.WriteFile(path.Join(env, "minerlist.sh"), []byte(minerlistTxt), os.ModePerm); err != nil {
-		panic(err)
+	if err := files.WriteFileAtomic(path.Join(env, "minerlist.sh"), []byte(minerlistTxt), files.PublicFileMode); err != nil {
+		return err
 	}
 
 	log.Infof("save miner list %s", minerlistTxt)
+	return nil
 }
 
-func generateStaticNodesFile(sortedNodes []*Node) {
+// staticNodesData returns the content of `static-nodes.json` with the nodes at their placement.
+func staticNodesData(sortedNodes []*Node) ([]byte, error) {
 	staticNodes := make([]string, 0)
-	nodesPerMachine := len(sortedNodes) / len(config.Conf.IpList)
+	placement := placeNodes(len(sortedNodes))
 	for i, v := range sortedNodes {
-		ipIndex := i / nodesPerMachine
-		port := i%nodesPerMachine + config.Conf.StartPort
-		staticNodes = append(staticNodes, NodeStaticInfoTemp(v.ID(), config.Conf.IpList[ipIndex], port))
+		staticNodes = append(staticNodes, NodeStaticInfoTemp(v.ID(), placement[i].Host, placement[i].Port))
 	}
+	return json.MarshalIndent(staticNodes, "", "\t")
+}
 
-	enc, err := json.MarshalIndent(staticNodes, "", "\t")
+func generateStaticNodesFile(sortedNodes []*Node) error {
+	enc, err := staticNodesData(sortedNodes)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	log.Info(string(enc))
-	if err := ioutil.WriteFile(path.Join(env, "static-nodes.json"), enc, os.ModePerm); err != nil {
-		panic(err)
-	}
+	return files.WriteFileAtomic(path.Join(env, "static-nodes.json"), enc, files.PublicFileMode)
 }
 
 type AllocInfo struct {
-	PublicKey string `json:"publicKey"`
-	Balance   string `json:"balance"`
+	PublicKey string            `json:"publicKey,omitempty"`
+	Balance   string            `json:"balance"`
+	Nonce     string            `json:"nonce,omitempty"`
+	Code      string            `json:"code,omitempty"`
+	Storage   map[string]string `json:"storage,omitempty"`
 }
 
-func saveAlloc(sortedNodes []*Node, initAllocBalance string) {
+func saveAlloc(sortedNodes []*Node, initAllocBalance string) error {
 	nodesMap := make(map[string]*AllocInfo)
 	for _, v := range sortedNodes {
 		pubkey := v.PubKeyHex()
@@ -156,15 +233,14 @@ func saveAlloc(sortedNodes []*Node, initAllocBalance string) {
 
 	enc, err := json.MarshalIndent(nodesMap, "", "\t")
 	if err != nil {
-		panic(err)
+		return err
 	}
 	log.Info(string(enc))
-	if err := ioutil.WriteFile(path.Join(env, "alloc-nodes.json"), enc, os.ModePerm); err != nil {
-		panic(err)
-	}
+	return files.WriteFileAtomic(path.Join(env, "alloc-nodes.json"), enc, files.PublicFileMode)
 }
 
-func saveGenesis(sortedNodes []*Node, initAllocBalance string) {
+// genesisAlloc returns the alloc of the validators and predeploys, and the extra of the genesis.
+func genesisAlloc(sortedNodes []*Node, initAllocBalance string) (map[string]*AllocInfo, string, error) {
 	nodesMap := make(map[string]*AllocInfo)
 	for _, v := range sortedNodes {
 		pubkey := v.PubKeyHex()
@@ -174,9 +250,12 @@ func saveGenesis(sortedNodes []*Node, initAllocBalance string) {
 		}
 	}
 
-	alloc, err := json.MarshalIndent(nodesMap, "", "\t")
+	predeploys, err := predeployAlloc(sortedNodes)
 	if err != nil {
-		panic(err)
+		return nil, "", err
+	}
+	for addr, v := range predeploys {
+		nodesMap[addr] = v
 	}
 
 	list := make([]common.Address, 0)
@@ -186,13 +265,53 @@ func saveGenesis(sortedNodes []*Node, initAllocBalance string) {
 
 	extra, err := Encode(list)
 	if err != nil {
-		panic(err)
+		return nil, "", err
 	}
+	return nodesMap, extra, nil
+}
 
+// genesisData returns the content of a genesis file which is not seeded from a state dump, and
+// the identity of its block.
+func genesisData(nodesMap map[string]*AllocInfo, extra string) ([]byte, *GenesisInfo, error) {
+	alloc, err := json.MarshalIndent(nodesMap, "", "\t")
+	if err != nil {
+		return nil, nil, err
+	}
 	data := genesisTemplate(string(alloc), extra)
-	if err := ioutil.WriteFile(path.Join(env, "genesis.json"), []byte(data), os.ModePerm); err != nil {
-		panic(err)
+
+	genesis := new(core.Genesis)
+	if err := json.Unmarshal([]byte(data), genesis); err != nil {
+		return nil, nil, err
 	}
+	return []byte(data), ComputeGenesisInfo(genesis), nil
+}
+
+func saveGenesis(sortedNodes []*Node, initAllocBalance string) (*GenesisInfo, error) {
+	nodesMap, extra, err := genesisAlloc(sortedNodes, initAllocBalance)
+	if err != nil {
+		return nil, err
+	}
+
+	var info *GenesisInfo
+	if config.Conf.StateDump != nil {
+		if info, err = saveDumpGenesis(path.Join(env, "genesis.json"), nodesMap, extra); err != nil {
+			return nil, err
+		}
+	} else {
+		var data []byte
+		if data, info, err = genesisData(nodesMap, extra); err != nil {
+			return nil, err
+		}
+		if err := files.WriteFileAtomic(path.Join(env, "genesis.json"), data, files.PublicFileMode); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := files.WriteFileAtomic(path.Join(env, genesisHashFile), []byte(info.Hash.Hex()+"\n"), files.PublicFileMode); err != nil {
+		return nil, err
+	}
+	log.Infof("genesis hash %s, state root %s", info.Hash.Hex(), info.StateRoot.Hex())
+	return info, nil
 }
 
 /*
@@ -233,10 +352,17 @@ func saveGenesis(sortedNodes []*Node, initAllocBalance string) {
 var zero = big.NewInt(0)
 
 func genesisTemplate(alloc, extra string) string {
-	return fmt.Sprintf(`
+	head, tail := genesisTemplateParts(extra)
+	return head + alloc + tail
+}
+
+// genesisTemplateParts returns the genesis template around the alloc, which is streamed in
+// between when the genesis is seeded from a state dump.
+func genesisTemplateParts(extra string) (string, string) {
+	head := fmt.Sprintf(`
 {
     "config": {
-        "chainId": 60801, 
+        "chainId": %d,
         "homesteadBlock": 0,
         "eip150Block": 0,
         "eip155Block": 0,
@@ -251,7 +377,8 @@ func genesisTemplate(alloc, extra string) string {
             "protocol": "basic"
         }
     },
-    "alloc": %s,
+    "alloc": `, config.Conf.ChainID)
+	tail := fmt.Sprintf(`,
     "coinbase": "0x0000000000000000000000000000000000000000",
     "difficulty": "0x1",
     "extraData": "%s",
@@ -260,7 +387,8 @@ func genesisTemplate(alloc, extra string) string {
     "mixhash": "0x0000000000000000000000000000000000000000000000000000000000000000",
     "parentHash": "0x0000000000000000000000000000000000000000000000000000000000000000",
     "timestamp": "0x00"
-}`, alloc, extra)
+}`, extra)
+	return head, tail
 }
 
 var defaultGenesisConfig = core.Genesis{
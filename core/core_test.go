@@ -19,6 +19,7 @@
 package core
 
 import (
+	"os"
 	"testing"
 
 	"github.com/dylenfu/zion-makeup/pkg/files"
@@ -29,6 +30,9 @@ import (
 func TestPrintMinerList(t *testing.T) {
 	filepath := "/Users/dylen/software/hotstuff/zion-makeup/build/extra"
 	nodesList := []string{}
+	if _, err := os.Stat(filepath); os.IsNotExist(err) {
+		t.Skipf("%s not found", filepath)
+	}
 
 	enc, err := files.ReadFile(filepath)
 	if err != nil {
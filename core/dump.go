@@ -0,0 +1,431 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+)
+
+const (
+	// dumpBufferSize denotes the read and write buffer of the streamed dump and genesis.
+	dumpBufferSize = 1 << 20
+
+	// stateFlushInterval denotes how many accounts are applied before the state is committed to
+	// disk, which keeps memory bounded while computing the root of a large genesis.
+	stateFlushInterval = 10000
+
+	// genesisMemoryLimit denotes the size above which a genesis file is streamed instead of decoded
+	// at once.
+	genesisMemoryLimit = 64 << 20
+)
+
+// dumpAccount denotes an account in `geth dump` output, the address and the hashed key are only
+// set in the iterative format.
+type dumpAccount struct {
+	Address *common.Address   `json:"address,omitempty"`
+	Key     string            `json:"key,omitempty"`
+	Balance string            `json:"balance"`
+	Nonce   uint64            `json:"nonce"`
+	Code    string            `json:"code,omitempty"`
+	Storage map[string]string `json:"storage,omitempty"`
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expect %s, got %v", delim, tok)
+	}
+	return nil
+}
+
+func nextKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expect object key, got %v", tok)
+	}
+	return key, nil
+}
+
+// iterateDump streams the accounts of a state dump without loading it into memory. both the
+// `{"root": ..., "accounts": {...}}` json and the one account per line jsonl format are supported.
+// accounts without address are skipped with one warning for all of them.
+func iterateDump(p string, fn func(common.Address, *dumpAccount) error) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReaderSize(f, dumpBufferSize))
+
+	// accounts without preimage are dumped without address and can't be placed in genesis
+	skipped := 0
+	defer func() {
+		if skipped > 0 {
+			warnf("skip %d dumped accounts without address", skipped)
+		}
+	}()
+	if strings.HasSuffix(p, ".jsonl") {
+		for {
+			acc := new(dumpAccount)
+			if err := dec.Decode(acc); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			// the leading line only contains the state root
+			if acc.Address == nil {
+				if acc.Key != "" {
+					log.Debugf("skip dumped account %s without address", acc.Key)
+					skipped++
+				}
+				continue
+			}
+			if err := fn(*acc.Address, acc); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := nextKey(dec)
+		if err != nil {
+			return err
+		}
+		if key != "accounts" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := expectDelim(dec, '{'); err != nil {
+			return err
+		}
+		for dec.More() {
+			addr, err := nextKey(dec)
+			if err != nil {
+				return err
+			}
+			acc := new(dumpAccount)
+			if err := dec.Decode(acc); err != nil {
+				return fmt.Errorf("invalid account %s, err: %v", addr, err)
+			}
+			// the key is `pre(<hash>)` for accounts without preimage
+			if !common.IsHexAddress(addr) {
+				log.Debugf("skip dumped account %s without address", addr)
+				skipped++
+				continue
+			}
+			if err := fn(common.HexToAddress(addr), acc); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dumpFilter struct {
+	include  map[common.Address]bool
+	exclude  map[common.Address]bool
+	balances map[common.Address]string
+}
+
+func newDumpFilter(conf *config.StateDump) *dumpFilter {
+	filter := &dumpFilter{
+		include:  make(map[common.Address]bool),
+		exclude:  make(map[common.Address]bool),
+		balances: make(map[common.Address]string),
+	}
+	for _, v := range conf.Include {
+		filter.include[common.HexToAddress(v)] = true
+	}
+	for _, v := range conf.Exclude {
+		filter.exclude[common.HexToAddress(v)] = true
+	}
+	for k, v := range conf.Balances {
+		filter.balances[common.HexToAddress(k)] = v
+	}
+	return filter
+}
+
+func (f *dumpFilter) keep(addr common.Address) bool {
+	if len(f.include) > 0 && !f.include[addr] {
+		return false
+	}
+	return !f.exclude[addr]
+}
+
+// saveDumpGenesis stream the configured state dump into the alloc of the genesis file, the validators
+// and predeploys in overrides are merged on top of the dumped accounts.
+func saveDumpGenesis(p string, overrides map[string]*AllocInfo, extra string) (*GenesisInfo, error) {
+	conf := config.Conf.StateDump
+	if conf.Path == "" {
+		return nil, fmt.Errorf("path of the state dump required")
+	}
+	filter := newDumpFilter(conf)
+
+	pending := make(map[common.Address]*AllocInfo)
+	for k, v := range overrides {
+		pending[common.HexToAddress(k)] = v
+	}
+
+	f, err := files.CreateAtomic(p, files.PublicFileMode)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriterSize(f, dumpBufferSize)
+
+	first := true
+	write := func(addr common.Address, acc *AllocInfo) error {
+		enc, err := json.Marshal(acc)
+		if err != nil {
+			return err
+		}
+		sep := ","
+		if first {
+			sep, first = "", false
+		}
+		_, err = fmt.Fprintf(w, "%s\n\t\"%s\": %s", sep, addr.Hex(), enc)
+		return err
+	}
+
+	head, tail := genesisTemplateParts(extra)
+	w.WriteString(head + "{")
+
+	count := 0
+	err = iterateDump(conf.Path, func(addr common.Address, acc *dumpAccount) error {
+		if !filter.keep(addr) {
+			return nil
+		}
+
+		alloc := &AllocInfo{Balance: acc.Balance, Code: acc.Code}
+		if acc.Nonce > 0 {
+			alloc.Nonce = hexutil.EncodeUint64(acc.Nonce)
+		}
+		if len(acc.Storage) > 0 {
+			alloc.Storage = make(map[string]string)
+			for k, v := range acc.Storage {
+				alloc.Storage[common.HexToHash(k).Hex()] = common.HexToHash(v).Hex()
+			}
+		}
+		if conf.Balance != "" {
+			alloc.Balance = conf.Balance
+		}
+		if balance, ok := filter.balances[addr]; ok {
+			alloc.Balance = balance
+		}
+
+		if v, ok := pending[addr]; ok {
+			alloc.Balance = v.Balance
+			alloc.PublicKey = v.PublicKey
+			if v.Code != "" {
+				alloc.Code, alloc.Storage = v.Code, v.Storage
+			}
+			delete(pending, addr)
+		}
+
+		count++
+		return write(addr, alloc)
+	})
+	if err != nil {
+		f.Abort()
+		return nil, fmt.Errorf("read state dump %s failed, err: %v", conf.Path, err)
+	}
+
+	rest := make([]common.Address, 0, len(pending))
+	for addr := range pending {
+		rest = append(rest, addr)
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].Hex() < rest[j].Hex() })
+	for _, addr := range rest {
+		if err := write(addr, pending[addr]); err != nil {
+			f.Abort()
+			return nil, err
+		}
+	}
+
+	w.WriteString("\n}" + tail)
+	if err := w.Flush(); err != nil {
+		f.Abort()
+		return nil, err
+	}
+	if err := f.Commit(); err != nil {
+		return nil, err
+	}
+	log.Infof("%d accounts seeded from state dump %s", count, conf.Path)
+
+	return fileGenesisInfo(p)
+}
+
+// fileGenesisInfo computes the identity of the genesis file, which is decoded at once unless it is
+// larger than genesisMemoryLimit. generate and verify-manifest pick the same way for the same file.
+func fileGenesisInfo(p string) (*GenesisInfo, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > genesisMemoryLimit {
+		return computeGenesisInfoStreaming(p)
+	}
+	genesis := new(core.Genesis)
+	if err := files.ReadJsonFile(p, genesis); err != nil {
+		return nil, fmt.Errorf("read genesis %s failed, err: %v", p, err)
+	}
+	return ComputeGenesisInfo(genesis), nil
+}
+
+// computeGenesisInfoStreaming is the streaming version of ComputeGenesisInfo for genesis files which
+// are too large to be decoded at once. the alloc is applied to a disk backed state which is committed
+// periodically, and the header is built by `Genesis.ToBlock` with the state root replaced.
+func computeGenesisInfoStreaming(p string) (*GenesisInfo, error) {
+	dir, err := ioutil.TempDir("", "zion-makeup-state-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := rawdb.NewLevelDBDatabase(dir, 128, 128, "", false)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	sdb := state.NewDatabase(db)
+	statedb, err := state.New(common.Hash{}, sdb, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReaderSize(f, dumpBufferSize))
+
+	fields := make(map[string]json.RawMessage)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	count := 0
+	for dec.More() {
+		key, err := nextKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		if key != "alloc" {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, err
+			}
+			fields[key] = raw
+			continue
+		}
+
+		if err := expectDelim(dec, '{'); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			addr, err := nextKey(dec)
+			if err != nil {
+				return nil, err
+			}
+			var acc core.GenesisAccount
+			if err := dec.Decode(&acc); err != nil {
+				return nil, fmt.Errorf("invalid alloc %s, err: %v", addr, err)
+			}
+
+			address := common.HexToAddress(addr)
+			if acc.Balance != nil {
+				statedb.AddBalance(address, acc.Balance)
+			}
+			statedb.SetCode(address, acc.Code)
+			statedb.SetNonce(address, acc.Nonce)
+			for k, v := range acc.Storage {
+				statedb.SetState(address, k, v)
+			}
+
+			if count++; count%stateFlushInterval == 0 {
+				root, err := statedb.Commit(false)
+				if err != nil {
+					return nil, err
+				}
+				if err := sdb.TrieDB().Commit(root, false, nil); err != nil {
+					return nil, err
+				}
+				if statedb, err = state.New(root, sdb, nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return nil, err
+		}
+	}
+
+	root, err := statedb.Commit(false)
+	if err != nil {
+		return nil, err
+	}
+
+	// the header does not depend on the alloc except for the state root
+	fields["alloc"] = json.RawMessage("{}")
+	enc, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	genesis := new(core.Genesis)
+	if err := json.Unmarshal(enc, genesis); err != nil {
+		return nil, err
+	}
+	header := genesis.ToBlock(rawdb.NewMemoryDatabase()).Header()
+	header.Root = root
+
+	return &GenesisInfo{Hash: header.Hash(), StateRoot: root}, nil
+}
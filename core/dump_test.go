@@ -0,0 +1,218 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+)
+
+const (
+	dumpAddr1 = "0x1000000000000000000000000000000000000001"
+	dumpAddr2 = "0x2000000000000000000000000000000000000002"
+)
+
+// dumpTestDir sets a config for the genesis template and returns a temporary directory.
+func dumpTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "zion-makeup-dump-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.Conf
+	config.Conf = &config.Config{ChainID: 60801}
+	resetWarnings()
+	t.Cleanup(func() {
+		config.Conf = conf
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestIterateDump(t *testing.T) {
+	dir := dumpTestDir(t)
+	dumps := map[string]string{
+		"state.json": `{
+	"root": "0x0000000000000000000000000000000000000000000000000000000000000001",
+	"accounts": {
+		"` + dumpAddr1 + `": {"balance": "10", "nonce": 1, "code": "0x6000", "storage": {"0x01": "0x02"}},
+		"pre(0x0300000000000000000000000000000000000000000000000000000000000003)": {"balance": "30", "nonce": 0},
+		"` + dumpAddr2 + `": {"balance": "20", "nonce": 0}
+	}
+}`,
+		"state.jsonl": `{"root": "0x0000000000000000000000000000000000000000000000000000000000000001"}
+{"balance": "10", "nonce": 1, "code": "0x6000", "storage": {"0x01": "0x02"}, "address": "` + dumpAddr1 + `", "key": "0x01"}
+{"balance": "30", "nonce": 0, "key": "0x0300000000000000000000000000000000000000000000000000000000000003"}
+{"balance": "20", "nonce": 0, "address": "` + dumpAddr2 + `", "key": "0x02"}
+`,
+	}
+	for name, data := range dumps {
+		p := path.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		resetWarnings()
+		got := make([]string, 0)
+		err := iterateDump(p, func(addr common.Address, acc *dumpAccount) error {
+			got = append(got, fmt.Sprintf("%s %s %d %s %d", addr.Hex(), acc.Balance, acc.Nonce, acc.Code, len(acc.Storage)))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		expect := []string{
+			common.HexToAddress(dumpAddr1).Hex() + " 10 1 0x6000 1",
+			common.HexToAddress(dumpAddr2).Hex() + " 20 0  0",
+		}
+		if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+			t.Errorf("%s: accounts\n%s\nexpect\n%s", name, strings.Join(got, "\n"), strings.Join(expect, "\n"))
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "skip 1 dumped accounts") {
+			t.Errorf("%s: expect one warning of the skipped account, got %v", name, warnings)
+		}
+	}
+}
+
+func TestDumpFilter(t *testing.T) {
+	a, b := common.HexToAddress(dumpAddr1), common.HexToAddress(dumpAddr2)
+	for i, c := range []struct {
+		conf    *config.StateDump
+		keepA   bool
+		keepB   bool
+		balance string
+	}{
+		{&config.StateDump{}, true, true, ""},
+		{&config.StateDump{Include: []string{dumpAddr1}}, true, false, ""},
+		{&config.StateDump{Exclude: []string{dumpAddr1}}, false, true, ""},
+		{&config.StateDump{Include: []string{dumpAddr1, dumpAddr2}, Exclude: []string{dumpAddr2}}, true, false, ""},
+		{&config.StateDump{Balances: map[string]string{strings.ToUpper(dumpAddr1[2:]): "5"}}, true, true, "5"},
+	} {
+		f := newDumpFilter(c.conf)
+		if f.keep(a) != c.keepA || f.keep(b) != c.keepB {
+			t.Errorf("case %d: keep %v %v, expect %v %v", i, f.keep(a), f.keep(b), c.keepA, c.keepB)
+		}
+		if f.balances[a] != c.balance {
+			t.Errorf("case %d: balance %q, expect %q", i, f.balances[a], c.balance)
+		}
+	}
+}
+
+// TestComputeGenesisInfoStreaming checks the streamed identity of a genesis against the one of the
+// chain library, with enough accounts to commit the state in between.
+func TestComputeGenesisInfoStreaming(t *testing.T) {
+	dir := dumpTestDir(t)
+	alloc := make(map[string]*AllocInfo)
+	for i := 0; i < stateFlushInterval+10; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i + 1)))
+		alloc[addr.Hex()] = &AllocInfo{Balance: fmt.Sprintf("%d", i+1)}
+	}
+	alloc[dumpAddr1] = &AllocInfo{
+		Balance: "1",
+		Nonce:   "0x2",
+		Code:    "0x6000",
+		Storage: map[string]string{common.HexToHash("0x1").Hex(): common.HexToHash("0x2").Hex()},
+	}
+	extra, err := Encode([]common.Address{common.HexToAddress(dumpAddr2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, expect, err := genesisData(alloc, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := path.Join(dir, "genesis.json")
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := computeGenesisInfoStreaming(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *expect {
+		t.Fatalf("streamed hash %s root %s, expect hash %s root %s",
+			got.Hash.Hex(), got.StateRoot.Hex(), expect.Hash.Hex(), expect.StateRoot.Hex())
+	}
+	if got, err = fileGenesisInfo(p); err != nil || *got != *expect {
+		t.Fatalf("genesis file info %+v, err %v, expect %+v", got, err, expect)
+	}
+}
+
+func TestSaveDumpGenesis(t *testing.T) {
+	dir := dumpTestDir(t)
+	dump := path.Join(dir, "state.jsonl")
+	err := ioutil.WriteFile(dump, []byte(`{"root": "0x0000000000000000000000000000000000000000000000000000000000000001"}
+{"balance": "10", "nonce": 1, "code": "0x6000", "address": "`+dumpAddr1+`", "key": "0x01"}
+{"balance": "20", "nonce": 0, "address": "`+dumpAddr2+`", "key": "0x02"}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validator := common.HexToAddress("0x3000000000000000000000000000000000000003")
+	overrides := map[string]*AllocInfo{
+		common.HexToAddress(dumpAddr2).Hex(): {PublicKey: "0x02", Balance: "200"},
+		validator.Hex():                      {PublicKey: "0x03", Balance: "300"},
+	}
+	config.Conf.StateDump = &config.StateDump{
+		Path:     dump,
+		Balance:  "7",
+		Balances: map[string]string{dumpAddr1: "11"},
+	}
+	p := path.Join(dir, "genesis.json")
+	info, err := saveDumpGenesis(p, overrides, "0x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := new(core.Genesis)
+	if err := files.ReadJsonFile(p, genesis); err != nil {
+		t.Fatal(err)
+	}
+	for addr, balance := range map[common.Address]int64{
+		common.HexToAddress(dumpAddr1): 11,
+		common.HexToAddress(dumpAddr2): 200,
+		validator:                      300,
+	} {
+		acc, ok := genesis.Alloc[addr]
+		if !ok || acc.Balance.Int64() != balance {
+			t.Errorf("%s: balance %v, expect %d", addr.Hex(), acc.Balance, balance)
+		}
+	}
+	if acc := genesis.Alloc[common.HexToAddress(dumpAddr1)]; acc.Nonce != 1 || len(acc.Code) != 2 {
+		t.Errorf("dumped nonce %d and code %x are not kept", acc.Nonce, acc.Code)
+	}
+	if expect := ComputeGenesisInfo(genesis); *info != *expect {
+		t.Errorf("genesis info %+v, expect %+v", info, expect)
+	}
+
+	config.Conf.StateDump.Path = ""
+	if _, err := saveDumpGenesis(p, overrides, "0x"); err == nil || !strings.Contains(err.Error(), "path of the state dump required") {
+		t.Errorf("expect missing path error, got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus/hotstuff/backend"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const (
+	goldenDir   = "testdata/network"
+	goldenSeed  = 33
+	goldenNodes = 4
+)
+
+// seedKeys makes the node keys generated by the test deterministic.
+func seedKeys(t *testing.T, seed int64) {
+	source := keySource
+	keySource = rand.New(rand.NewSource(seed))
+	t.Cleanup(func() { keySource = source })
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n <= 32; n++ {
+		validators := make([]common.Address, n)
+		for i := range validators {
+			r.Read(validators[i][:])
+		}
+
+		extra, err := Encode(validators)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := hexutil.Decode(extra)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) < types.HotstuffExtraVanity || !bytes.Equal(raw[:types.HotstuffExtraVanity], make([]byte, types.HotstuffExtraVanity)) {
+			t.Fatalf("%d validators: vanity is not zero", n)
+		}
+		payload, err := types.ExtractHotstuffExtraPayload(raw)
+		if err != nil {
+			t.Fatalf("%d validators: %v", n, err)
+		}
+		if !sameAddresses(payload.Validators, validators) {
+			t.Errorf("%d validators: got %v, expect %v", n, payload.Validators, validators)
+		}
+		if len(payload.Seal) != types.HotstuffExtraSeal || len(payload.CommittedSeal) != 0 {
+			t.Errorf("%d validators: seal of %d bytes and %d committed seals", n, len(payload.Seal), len(payload.CommittedSeal))
+		}
+	}
+}
+
+func TestSortNodes(t *testing.T) {
+	seedKeys(t, 1)
+	nodes, err := generateNodes(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := make([]common.Address, 0, len(nodes))
+	for _, v := range nodes {
+		addrs = append(addrs, v.Address)
+	}
+	expect := backend.NewDefaultValSet(addrs).AddressList()
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		shuffled := make([]*Node, 0, len(nodes))
+		for _, j := range r.Perm(len(nodes)) {
+			shuffled = append(shuffled, nodes[j])
+		}
+		sorted := SortNodes(shuffled)
+		if len(sorted) != len(expect) {
+			t.Fatalf("expect %d nodes, got %d", len(expect), len(sorted))
+		}
+		for j, v := range sorted {
+			if v.Address != expect[j] {
+				t.Fatalf("permutation %d: node %d is %s, expect %s", i, j, v.Address.Hex(), expect[j].Hex())
+			}
+			if crypto.PubkeyToAddress(v.NodeKey.PublicKey) != v.Address {
+				t.Fatalf("permutation %d: node %d is paired with another key", i, j)
+			}
+		}
+	}
+}
+
+func TestPubkeyID(t *testing.T) {
+	seedKeys(t, 1)
+	ip := net.ParseIP("10.0.0.1")
+	nodes, err := generateNodes(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range nodes {
+		pub := &v.NodeKey.PublicKey
+		if id, expect := PubkeyID(pub).String(), fmt.Sprintf("%x", crypto.FromECDSAPub(pub)[1:]); id != expect {
+			t.Fatalf("node %d: id %s, expect %s", i, id, expect)
+		}
+
+		port := 30300 + i
+		url := NodeStaticInfoTemp(v.ID(), ip.String(), port)
+		if expect := enode.NewV4(pub, ip, port, 0).URLv4(); url != expect {
+			t.Fatalf("node %d: url %s, expect %s", i, url, expect)
+		}
+		n, err := enode.ParseV4(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.ID() != enode.PubkeyToIDV4(pub) || n.TCP() != port {
+			t.Fatalf("node %d: url %s is parsed as %s", i, url, n)
+		}
+	}
+}
+
+// listFiles returns the files under dir relative to it, in order.
+func listFiles(dir string) ([]string, error) {
+	list := make([]string, 0)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err == nil {
+			list = append(list, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	sort.Strings(list)
+	return list, err
+}
+
+// TestGoldenNetwork generates a network from seeded keys and compares it with the golden files, run
+// with -update to rewrite them after an intended change of the output.
+func TestGoldenNetwork(t *testing.T) {
+	golden, err := filepath.Abs(goldenDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedKeys(t, goldenSeed)
+	dir := generateTestNetwork(t, goldenNodes)
+	if err := VerifyManifest("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := listFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.RemoveAll(golden); err != nil {
+			t.Fatal(err)
+		}
+		for _, rel := range list {
+			enc, err := ioutil.ReadFile(filepath.Join(dir, rel))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(golden, rel)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(golden, rel), enc, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	expect, err := listFiles(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(list) != fmt.Sprint(expect) {
+		t.Fatalf("generated files %v, expect %v", list, expect)
+	}
+	for _, rel := range list {
+		got, err := ioutil.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadFile(filepath.Join(golden, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from the golden file:\n%s\nexpect:\n%s", rel, got, want)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/dylenfu/zion-makeup/pkg/supervisor"
+)
+
+const (
+	// runFolder holds the datadirs, logs and pid files of a locally launched network, it is not
+	// a network artifact and kept when the network is generated again.
+	runFolder = "run"
+
+	upPidFile     = "up.pid"
+	staticNodes   = "static-nodes.json"
+	launchFile    = "launch.json"
+	localHost     = "127.0.0.1"
+	downKillDelay = 5 * time.Second
+)
+
+// LaunchOptions denotes how the nodes of a local network are run and supervised.
+type LaunchOptions struct {
+	Binary       string
+	RPCPort      int
+	Restart      supervisor.Policy
+	MaxRestarts  int
+	RestartDelay time.Duration
+	StopTimeout  time.Duration
+	ExtraArgs    []string
+	// Admin enables the admin rpc api, which `chaos` needs to partition the network.
+	Admin bool
+}
+
+// LaunchNode denotes a node of a locally launched network, it is saved in `run/launch.json` so
+// that other commands find the endpoints of the nodes.
+type LaunchNode struct {
+	Index   int    `json:"index"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	RPC     string `json:"rpc"`
+	DataDir string `json:"datadir"`
+	LogFile string `json:"log"`
+	PidFile string `json:"pid"`
+	Hold    string `json:"hold"`
+}
+
+// Launch denotes the state of a locally launched network.
+type Launch struct {
+	Binary      string            `json:"binary"`
+	Restart     supervisor.Policy `json:"restart"`
+	MaxRestarts int               `json:"maxRestarts"`
+	Admin       bool              `json:"admin"`
+	Nodes       []*LaunchNode     `json:"nodes"`
+}
+
+func runPath(dir string, elem ...string) string {
+	return path.Join(append([]string{dir, runFolder}, elem...)...)
+}
+
+// loadLaunch reads the state of the network launched in the environment.
+func loadLaunch(dir string) (*Launch, error) {
+	launch := new(Launch)
+	if err := files.ReadJsonFile(runPath(dir, launchFile), launch); err != nil {
+		return nil, fmt.Errorf("network in %s is not launched, err: %v", dir, err)
+	}
+	return launch, nil
+}
+
+// nodeArgs returns the command line of a node, the same as the launch script in bundles except
+// that the http rpc is enabled on the loopback address for `status`, and the admin api only if
+// requested for the partitions of `chaos`.
+func nodeArgs(dir string, node *HostNode, launch *LaunchNode, opts *LaunchOptions) []string {
+	api := "eth,net,web3,hotstuff"
+	if opts.Admin {
+		api += ",admin"
+	}
+	args := []string{
+		"--datadir", launch.DataDir,
+		"--nodekey", path.Join(dir, "nodes", fmt.Sprintf("node%d", node.Index), "nodekey"),
+		"--port", strconv.Itoa(node.Port),
+		"--networkid", strconv.FormatUint(config.Conf.ChainID, 10),
+		"--syncmode", "full",
+		"--nodiscover",
+		"--http", "--http.addr", localHost, "--http.port", strconv.Itoa(opts.RPCPort + node.Index),
+		"--http.api", api,
+		"--mine", "--miner.etherbase", node.Node.Address.Hex(),
+	}
+	return append(args, opts.ExtraArgs...)
+}
+
+// prepareNode initializes the datadir of the node with genesis if it is not yet, and writes the
+// static peers with all hosts replaced by the loopback address.
+func prepareNode(dir string, launch *LaunchNode, list []*HostNode, opts *LaunchOptions) error {
+	if _, err := os.Stat(path.Join(launch.DataDir, "geth", "chaindata")); os.IsNotExist(err) {
+		abs, err := filepath.Abs(path.Join(dir, "genesis.json"))
+		if err != nil {
+			return err
+		}
+		initProc := &supervisor.Process{
+			Name:    fmt.Sprintf("node%d init", launch.Index),
+			Path:    opts.Binary,
+			Args:    []string{"init", "--datadir", launch.DataDir, abs},
+			LogFile: launch.LogFile,
+		}
+		if err := supervisor.RunOnce(initProc); err != nil {
+			return err
+		}
+		log.Infof("node%d datadir %s initialized", launch.Index, launch.DataDir)
+	}
+
+	return writeStaticPeers(launch, list, nil)
+}
+
+// writeStaticPeers writes the static peers of the node at the loopback address, peers are limited
+// to the indexes in group unless it is nil.
+func writeStaticPeers(launch *LaunchNode, list []*HostNode, group map[int]bool) error {
+	peers := make([]string, 0, len(list))
+	for _, v := range list {
+		if v.Index != launch.Index && (group == nil || group[v.Index]) {
+			peers = append(peers, NodeStaticInfoTemp(v.Node.ID(), localHost, v.Port))
+		}
+	}
+	gethDir := path.Join(launch.DataDir, "geth")
+	if err := os.MkdirAll(gethDir, files.SecretDirMode); err != nil {
+		return err
+	}
+	return files.WriteJsonFile(path.Join(gethDir, staticNodes), peers, true)
+}
+
+// Up initializes the datadirs of all nodes of the environment and runs them with the binary on this
+// host, until SIGINT or SIGTERM received. exited nodes are restarted by the restart policy.
+func Up(dir string, opts *LaunchOptions) error {
+	env = path.Join(folder, dir)
+	if opts.Binary == "" {
+		return fmt.Errorf("path of the zion binary required")
+	}
+	binary, err := filepath.Abs(opts.Binary)
+	if err != nil {
+		return err
+	}
+	opts.Binary = binary
+
+	list, err := loadNetwork(env)
+	if err != nil {
+		return err
+	}
+	ports := make(map[int]string)
+	for _, v := range list {
+		name := fmt.Sprintf("node%d", v.Index)
+		if other, ok := ports[v.Port]; ok {
+			return fmt.Errorf("%s and %s share port %d and can not run on one host", other, name, v.Port)
+		}
+		ports[v.Port] = name
+	}
+
+	if err := os.MkdirAll(runPath(env), files.SecretDirMode); err != nil {
+		return err
+	}
+	if pid, ok, err := supervisor.ReadPid(runPath(env, upPidFile)); err == nil && ok {
+		return fmt.Errorf("network in %s is already up, pid %d, run `down` first", env, pid)
+	}
+	if err := files.WriteFileAtomic(runPath(env, upPidFile), []byte(strconv.Itoa(os.Getpid())+"\n"), files.PublicFileMode); err != nil {
+		return err
+	}
+	defer os.Remove(runPath(env, upPidFile))
+
+	launch := &Launch{
+		Binary:      binary,
+		Restart:     opts.Restart,
+		MaxRestarts: opts.MaxRestarts,
+		Admin:       opts.Admin,
+		Nodes:       make([]*LaunchNode, 0, len(list)),
+	}
+	procs := make([]*supervisor.Process, 0, len(list))
+	for _, v := range list {
+		name := fmt.Sprintf("node%d", v.Index)
+		node := &LaunchNode{
+			Index:   v.Index,
+			Address: v.Node.Address.Hex(),
+			Port:    v.Port,
+			RPC:     fmt.Sprintf("http://%s:%d", localHost, opts.RPCPort+v.Index),
+			DataDir: runPath(env, name),
+			LogFile: runPath(env, name+".log"),
+			PidFile: runPath(env, name+".pid"),
+			Hold:    runPath(env, name+".hold"),
+		}
+		// a hold left by an interrupted chaos run would keep the node down
+		os.Remove(node.Hold)
+		if err := prepareNode(env, node, list, opts); err != nil {
+			return err
+		}
+		launch.Nodes = append(launch.Nodes, node)
+		procs = append(procs, &supervisor.Process{
+			Name:     name,
+			Path:     binary,
+			Args:     nodeArgs(env, v, node, opts),
+			LogFile:  node.LogFile,
+			PidFile:  node.PidFile,
+			HoldFile: node.Hold,
+		})
+	}
+	if err := files.WriteJsonFile(runPath(env, launchFile), launch, true); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Infof("%s received, stop all nodes", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	log.Infof("%d nodes of %s up, press ctrl-c to stop them", len(procs), env)
+	sup := &supervisor.Supervisor{
+		Policy:       opts.Restart,
+		MaxRestarts:  opts.MaxRestarts,
+		RestartDelay: opts.RestartDelay,
+		StopTimeout:  opts.StopTimeout,
+	}
+	return sup.Run(ctx, procs)
+}
+
+// Down stops the network launched by `up` in another process, the supervisor is interrupted so that
+// it stops the nodes gracefully, and nodes left by a dead supervisor are stopped by their pid files.
+func Down(dir string, timeout time.Duration) error {
+	env = path.Join(folder, dir)
+
+	if _, err := os.Stat(runPath(env, upPidFile)); err == nil {
+		if err := supervisor.Stop(runPath(env, upPidFile), timeout+downKillDelay); err != nil {
+			return err
+		}
+	}
+
+	launch, err := loadLaunch(env)
+	if err != nil {
+		return err
+	}
+	for _, v := range launch.Nodes {
+		if _, err := os.Stat(v.PidFile); os.IsNotExist(err) {
+			continue
+		}
+		if err := supervisor.Stop(v.PidFile, timeout); err != nil {
+			return fmt.Errorf("stop node%d failed, err: %v", v.Index, err)
+		}
+	}
+	log.Infof("network in %s is down", env)
+	return nil
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/pkg/supervisor"
+)
+
+// launchStub is a zion binary which initializes the datadir on `init`, and otherwise prints its
+// arguments and runs until interrupted.
+const launchStub = `#!/bin/sh
+if [ "$1" = "init" ]; then
+    mkdir -p "$3/geth/chaindata"
+    exit 0
+fi
+trap 'echo stopped; exit 0' INT TERM
+echo "started $$ $*"
+while true; do sleep 0.05; done
+`
+
+func writeLaunchStub(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "zion-makeup-launch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	p := path.Join(dir, "zion")
+	if err := ioutil.WriteFile(p, []byte(launchStub), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// deadPid returns the pid of a process which has exited.
+func deadPid(t *testing.T) string {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return strconv.Itoa(cmd.Process.Pid) + "\n"
+}
+
+// waitLog waits until the log file of the node contains s.
+func waitLog(t *testing.T, node *LaunchNode, s string) string {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if enc, err := ioutil.ReadFile(node.LogFile); err == nil && strings.Contains(string(enc), s) {
+			return string(enc)
+		}
+	}
+	t.Fatalf("node%d log has no %q", node.Index, s)
+	return ""
+}
+
+func TestUpDown(t *testing.T) {
+	dir := generateTestNetwork(t, 4)
+	binary := writeLaunchStub(t)
+	opts := &LaunchOptions{
+		Binary:       binary,
+		RPCPort:      18545,
+		Restart:      supervisor.RestartAlways,
+		RestartDelay: time.Millisecond,
+		StopTimeout:  5 * time.Second,
+	}
+
+	// pid files left by a killed `up` do not keep the network from starting
+	for _, name := range []string{upPidFile, "node0.pid"} {
+		writeTestFile(t, runPath(dir, name), deadPid(t))
+	}
+	writeTestFile(t, runPath(dir, "node1.hold"), "")
+
+	done := make(chan error, 1)
+	go func() { done <- Up("test", opts) }()
+	var launch *Launch
+	for deadline := time.Now().Add(5 * time.Second); launch == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("network is not launched")
+		}
+		launch, _ = loadLaunch(dir)
+	}
+	if len(launch.Nodes) != 4 || launch.Admin {
+		t.Fatalf("unexpected launch %+v", launch)
+	}
+	for _, v := range launch.Nodes {
+		out := waitLog(t, v, "started")
+		if !strings.Contains(out, "--http.addr 127.0.0.1 --http.port "+strconv.Itoa(opts.RPCPort+v.Index)) ||
+			!strings.Contains(out, "--http.api eth,net,web3,hotstuff ") {
+			t.Errorf("node%d: unexpected args %s", v.Index, out)
+		}
+		if _, err := os.Stat(path.Join(v.DataDir, "geth", staticNodes)); err != nil {
+			t.Errorf("node%d: static nodes not written, err %v", v.Index, err)
+		}
+	}
+	if pid, ok, err := supervisor.ReadPid(runPath(dir, upPidFile)); err != nil || !ok || pid != os.Getpid() {
+		t.Fatalf("up pid %d alive %v, err %v", pid, ok, err)
+	}
+	if err := Up("test", opts); err == nil || !strings.Contains(err.Error(), "is already up") {
+		t.Fatalf("expect the second up refused, got %v", err)
+	}
+
+	// ctrl-c stops all nodes gracefully
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range launch.Nodes {
+		waitLog(t, v, "stopped")
+		if _, err := os.Stat(v.PidFile); !os.IsNotExist(err) {
+			t.Errorf("node%d pid file is left, err %v", v.Index, err)
+		}
+	}
+	if _, err := os.Stat(runPath(dir, upPidFile)); !os.IsNotExist(err) {
+		t.Fatalf("up pid file is left, err %v", err)
+	}
+
+	// `down` stops a node left by a dead `up` and removes the stale pid files
+	node := exec.Command(binary)
+	node.Stdout, _ = os.Create(launch.Nodes[0].LogFile)
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- node.Wait() }()
+	waitLog(t, launch.Nodes[0], "started")
+	writeTestFile(t, launch.Nodes[0].PidFile, strconv.Itoa(node.Process.Pid)+"\n")
+	writeTestFile(t, launch.Nodes[1].PidFile, deadPid(t))
+	writeTestFile(t, runPath(dir, upPidFile), deadPid(t))
+
+	if err := Down("test", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node0 is not stopped")
+	}
+	for _, p := range []string{runPath(dir, upPidFile), launch.Nodes[0].PidFile, launch.Nodes[1].PidFile} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s is left, err %v", p, err)
+		}
+	}
+}
+
+func TestUpPortClash(t *testing.T) {
+	generateTestNetwork(t, 4)
+	// every host of a multi-host network starts from the same port
+	config.Conf.IpList = []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	if err := Run("clash", 4, config.Conf.InitBalance, AbortIfExist); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Up("clash", &LaunchOptions{Binary: writeLaunchStub(t)})
+	if err == nil || !strings.Contains(err.Error(), "node0 and node1 share port 30300") {
+		t.Fatalf("expect the port clash refused, got %v", err)
+	}
+	if _, err := os.Stat(runPath(path.Join(folder, "clash"))); !os.IsNotExist(err) {
+		t.Fatalf("refused up created the run folder, err %v", err)
+	}
+}
+
+func TestNodeArgsAdmin(t *testing.T) {
+	node := &HostNode{Index: 1, Port: 30301, Node: new(Node)}
+	for _, admin := range []bool{false, true} {
+		args := strings.Join(nodeArgs("test", node, &LaunchNode{}, &LaunchOptions{RPCPort: 8545, Admin: admin}), " ")
+		if strings.Contains(args, "admin") != admin || !strings.Contains(args, "--http.addr 127.0.0.1 --http.port 8546") {
+			t.Errorf("admin %v: unexpected args %s", admin, args)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	transferGas = 21000
+	callGas     = 200000
+)
+
+// LoadOptions denotes the transactions sent by `load`. transfers of Value are sent between the
+// senders, or calls of Data to the contract To if it is set. Count limits the number of transactions
+// if positive, and Settle denotes how long the inclusion of sent transactions is waited for.
+type LoadOptions struct {
+	StatusOptions
+	KeyFiles    []string
+	TPS         float64
+	Concurrency int
+	Duration    time.Duration
+	Count       int
+	Settle      time.Duration
+	To          string
+	Data        string
+	Value       *big.Int
+	Gas         uint64
+}
+
+// LoadReport denotes the outcome of a load run, latencies are measured from sending a transaction
+// to the first seen block which includes it. Dropped counts the ticks skipped while all workers
+// were busy, by which the target rate was not reached.
+type LoadReport struct {
+	Sent      int
+	Failed    int
+	Dropped   int
+	Included  int
+	Elapsed   time.Duration
+	Latencies []time.Duration
+	Errors    map[string]int
+}
+
+type loadSender struct {
+	key     *ecdsa.PrivateKey
+	address common.Address
+	nonce   uint64
+}
+
+// txSigner returns the raw signed transaction and its hash.
+type txSigner func(from *loadSender, nonce uint64, to common.Address, data []byte) ([]byte, common.Hash, error)
+
+type loadRun struct {
+	opts    *LoadOptions
+	clients []*rpc.Client
+	senders []*loadSender
+	sign    txSigner
+
+	next    uint64
+	mu      sync.Mutex
+	pending map[common.Hash]time.Time
+	report  *LoadReport
+}
+
+// Load sends signed transactions from the node keys of the environment and the extra key files to
+// the rpc endpoints of the nodes at the target rate, and reports the latency and inclusion.
+func Load(dir string, opts *LoadOptions) error {
+	env = path.Join(folder, dir)
+	targets, err := statusTargets(env, &opts.StatusOptions)
+	if err != nil {
+		return err
+	}
+	clients := make([]*rpc.Client, 0, len(targets))
+	for _, t := range targets {
+		clients = append(clients, t.Client)
+	}
+
+	keys := make([]*ecdsa.PrivateKey, 0)
+	list, err := loadNetwork(env)
+	if err != nil {
+		return err
+	}
+	for _, v := range list {
+		keys = append(keys, v.Node.NodeKey)
+	}
+	for _, p := range opts.KeyFiles {
+		key, err := crypto.LoadECDSA(p)
+		if err != nil {
+			return fmt.Errorf("load key %s failed, err: %v", p, err)
+		}
+		keys = append(keys, key)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Infof("%s received, stop sending", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	run := newLoadRun(opts, clients, keys)
+	if err := run.prepare(ctx); err != nil {
+		return err
+	}
+	report, err := run.run(ctx)
+	if err != nil {
+		return err
+	}
+	printLoadReport(os.Stdout, report)
+	return nil
+}
+
+func newLoadRun(opts *LoadOptions, clients []*rpc.Client, keys []*ecdsa.PrivateKey) *loadRun {
+	if opts.Gas == 0 {
+		opts.Gas = transferGas
+		if opts.To != "" {
+			opts.Gas = callGas
+		}
+	}
+	if opts.Value == nil {
+		opts.Value = new(big.Int)
+	}
+	senders := make([]*loadSender, 0, len(keys))
+	for _, key := range keys {
+		senders = append(senders, &loadSender{key: key, address: crypto.PubkeyToAddress(key.PublicKey)})
+	}
+	return &loadRun{
+		opts:    opts,
+		clients: clients,
+		senders: senders,
+		pending: make(map[common.Hash]time.Time),
+		report:  &LoadReport{Errors: make(map[string]int)},
+	}
+}
+
+// prepare queries the chain id, gas price and pending nonces of senders, and sets up the signer.
+func (r *loadRun) prepare(ctx context.Context) error {
+	if len(r.senders) == 0 {
+		return fmt.Errorf("no sender to send transactions")
+	}
+	if r.opts.TPS <= 0 {
+		return fmt.Errorf("invalid target tps %v", r.opts.TPS)
+	}
+	client := r.clients[0]
+	for _, s := range r.senders {
+		if err := r.syncNonce(ctx, client, s); err != nil {
+			return err
+		}
+	}
+	if r.sign != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	eth := ethclient.NewClient(client)
+	chainID, err := eth.ChainID(ctx)
+	if err != nil {
+		return fmt.Errorf("query chain id failed, err: %v", err)
+	}
+	gasPrice, err := eth.SuggestGasPrice(ctx)
+	if err != nil {
+		return fmt.Errorf("query gas price failed, err: %v", err)
+	}
+	signer := types.NewEIP155Signer(chainID)
+	r.sign = func(from *loadSender, nonce uint64, to common.Address, data []byte) ([]byte, common.Hash, error) {
+		tx := types.NewTx(&types.LegacyTx{
+			Nonce:    nonce,
+			GasPrice: gasPrice,
+			Gas:      r.opts.Gas,
+			To:       &to,
+			Value:    r.opts.Value,
+			Data:     data,
+		})
+		signed, err := types.SignTx(tx, signer, from.key)
+		if err != nil {
+			return nil, common.Hash{}, err
+		}
+		raw, err := signed.MarshalBinary()
+		if err != nil {
+			return nil, common.Hash{}, err
+		}
+		return raw, signed.Hash(), nil
+	}
+	log.Infof("load with %d senders on chain %d, gas price %s", len(r.senders), chainID, gasPrice)
+	return nil
+}
+
+func (r *loadRun) syncNonce(ctx context.Context, client *rpc.Client, s *loadSender) error {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	nonce, err := ethclient.NewClient(client).PendingNonceAt(ctx, s.address)
+	if err != nil {
+		return fmt.Errorf("query nonce of %s failed, err: %v", s.address.Hex(), err)
+	}
+	s.nonce = nonce
+	return nil
+}
+
+// run sends transactions at the target rate until the duration passes or the count is reached, and
+// waits for their inclusion. each sender is owned by a single worker so that its nonces are sent
+// in order.
+func (r *loadRun) run(ctx context.Context) (*LoadReport, error) {
+	to, data := common.Address{}, []byte(nil)
+	if r.opts.To != "" {
+		if !common.IsHexAddress(r.opts.To) {
+			return nil, fmt.Errorf("invalid contract address %s", r.opts.To)
+		}
+		to = common.HexToAddress(r.opts.To)
+		var err error
+		if data, err = hexutil.Decode(r.opts.Data); err != nil && r.opts.Data != "" {
+			return nil, fmt.Errorf("invalid call data, err: %v", err)
+		}
+	}
+
+	workers := r.opts.Concurrency
+	if workers <= 0 || workers > len(r.senders) {
+		workers = len(r.senders)
+	}
+	tokens := make(chan struct{}, workers)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		owned := make([]*loadSender, 0)
+		for i := w; i < len(r.senders); i += workers {
+			owned = append(owned, r.senders[i])
+		}
+		wg.Add(1)
+		go func(owned []*loadSender) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				if _, ok := <-tokens; !ok {
+					return
+				}
+				from := owned[i%len(owned)]
+				dst := to
+				if r.opts.To == "" {
+					dst = r.senders[(r.indexOf(from)+1)%len(r.senders)].address
+				}
+				r.send(ctx, from, dst, data)
+			}
+		}(owned)
+	}
+
+	tracked := make(chan struct{})
+	sendDone := make(chan struct{})
+	go func() {
+		r.track(ctx, sendDone)
+		close(tracked)
+	}()
+
+	interval := time.Duration(float64(time.Second) / r.opts.TPS)
+	ticker := time.NewTicker(interval)
+	deadline := time.After(r.opts.Duration)
+	log.Infof("send transactions at %.1f tps by %d workers for %s", r.opts.TPS, workers, r.opts.Duration)
+feed:
+	for sent := 0; r.opts.Count <= 0 || sent < r.opts.Count; {
+		select {
+		case <-ctx.Done():
+			break feed
+		case <-deadline:
+			break feed
+		case <-ticker.C:
+			// the feed never blocks on busy workers, or the deadline and ctx are not seen
+			select {
+			case tokens <- struct{}{}:
+				sent++
+			default:
+				r.report.Dropped++
+			}
+		}
+	}
+	ticker.Stop()
+	if ctx.Err() != nil {
+	drain:
+		for {
+			select {
+			case <-tokens:
+			default:
+				break drain
+			}
+		}
+	}
+	close(tokens)
+	wg.Wait()
+	r.report.Elapsed = time.Since(start)
+	close(sendDone)
+	<-tracked
+	return r.report, nil
+}
+
+func (r *loadRun) indexOf(s *loadSender) int {
+	for i, v := range r.senders {
+		if v == s {
+			return i
+		}
+	}
+	return 0
+}
+
+// send signs and sends the next transaction of the sender, the nonce is resynced from the node
+// after a failure so that a rejected transaction does not leave a gap. the nonce of a sender is
+// only touched by the worker which owns it.
+func (r *loadRun) send(ctx context.Context, from *loadSender, to common.Address, data []byte) {
+	client := r.clients[atomic.AddUint64(&r.next, 1)%uint64(len(r.clients))]
+	raw, hash, err := r.sign(from, from.nonce, to, data)
+	if err == nil {
+		sentAt := time.Now()
+		r.mu.Lock()
+		r.pending[hash] = sentAt
+		r.mu.Unlock()
+		if err = sendRaw(ctx, client, raw); err != nil {
+			r.mu.Lock()
+			delete(r.pending, hash)
+			r.mu.Unlock()
+		}
+	}
+
+	if err == nil {
+		from.nonce++
+		r.mu.Lock()
+		r.report.Sent++
+		r.mu.Unlock()
+		return
+	}
+
+	r.mu.Lock()
+	r.report.Failed++
+	r.report.Errors[errorKind(err)]++
+	r.mu.Unlock()
+	if err := r.syncNonce(ctx, client, from); err != nil {
+		log.Debugf("resync nonce failed, err: %v", err)
+	}
+}
+
+func sendRaw(ctx context.Context, client *rpc.Client, raw []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	return client.CallContext(ctx, nil, "eth_sendRawTransaction", hexutil.Encode(raw))
+}
+
+// errorKind groups errors by their message without the varying details.
+func errorKind(err error) string {
+	if e, ok := err.(rpc.Error); ok {
+		return e.Error()
+	}
+	msg := err.Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		return msg[i+2:]
+	}
+	return msg
+}
+
+// track follows the new blocks and marks the pending transactions they include, until sending is
+// done and all transactions are included or the settle time passes.
+func (r *loadRun) track(ctx context.Context, sendDone <-chan struct{}) {
+	client := r.clients[0]
+	height, err := blockNumber(ctx, client)
+	for err != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.opts.Interval):
+		}
+		height, err = blockNumber(ctx, client)
+	}
+
+	var settle <-chan time.Time
+	for {
+		if latest, err := blockNumber(ctx, client); err == nil {
+			for ; height < latest; height++ {
+				hashes, err := blockTransactions(ctx, client, height+1)
+				if err != nil {
+					break
+				}
+				r.include(hashes)
+			}
+		}
+
+		r.mu.Lock()
+		left := len(r.pending)
+		r.mu.Unlock()
+		select {
+		case <-sendDone:
+			if left == 0 {
+				return
+			}
+			if settle == nil {
+				log.Infof("wait %s for %d pending transactions", r.opts.Settle, left)
+				settle = time.After(r.opts.Settle)
+			}
+			sendDone = nil
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-settle:
+			return
+		case <-time.After(r.opts.Interval):
+		}
+	}
+}
+
+func blockNumber(ctx context.Context, client *rpc.Client) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	return ethclient.NewClient(client).BlockNumber(ctx)
+}
+
+// blockTransactions returns the transaction hashes of the block, which avoids decoding the full
+// transactions as `ethclient.BlockByNumber` does.
+func blockTransactions(ctx context.Context, client *rpc.Client, number uint64) ([]common.Hash, error) {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	var block struct {
+		Transactions []common.Hash `json:"transactions"`
+	}
+	if err := client.CallContext(ctx, &block, "eth_getBlockByNumber", hexutil.EncodeUint64(number), false); err != nil {
+		return nil, err
+	}
+	return block.Transactions, nil
+}
+
+func (r *loadRun) include(hashes []common.Hash) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, h := range hashes {
+		if sentAt, ok := r.pending[h]; ok {
+			delete(r.pending, h)
+			r.report.Included++
+			r.report.Latencies = append(r.report.Latencies, now.Sub(sentAt))
+		}
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func printLoadReport(w io.Writer, r *LoadReport) {
+	latencies := append([]time.Duration{}, r.Latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	rate := 0.0
+	if r.Sent > 0 {
+		rate = float64(r.Included) / float64(r.Sent) * 100
+	}
+	fmt.Fprintf(w, "sent %d, failed %d, included %d (%.1f%%) in %s, %.1f tps\n",
+		r.Sent, r.Failed, r.Included, rate, r.Elapsed.Round(time.Millisecond), float64(r.Sent)/r.Elapsed.Seconds())
+	fmt.Fprintf(w, "latency p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(latencies, 0.5), percentile(latencies, 0.9), percentile(latencies, 0.99), percentile(latencies, 1))
+
+	if r.Dropped > 0 {
+		fmt.Fprintf(w, "dropped %d ticks, the workers can not keep up with the target rate\n", r.Dropped)
+	}
+
+	kinds := make([]string, 0, len(r.Errors))
+	for k := range r.Errors {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	for _, k := range kinds {
+		fmt.Fprintf(w, "failure %q: %d\n", k, r.Errors[k])
+	}
+}
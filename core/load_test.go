@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// fakeChain accepts raw transactions which are their own hash, rejects every reject-th of them and
+// seals the accepted ones into a block whenever the height is queried.
+type fakeChain struct {
+	mu       sync.Mutex
+	delay    time.Duration
+	reject   int
+	received int
+	pool     []common.Hash
+	blocks   [][]common.Hash
+}
+
+func (c *fakeChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     uint64            `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Method == "eth_sendRawTransaction" {
+		time.Sleep(c.delay)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	switch req.Method {
+	case "eth_getTransactionCount":
+		res["result"] = "0x0"
+	case "eth_sendRawTransaction":
+		var raw string
+		json.Unmarshal(req.Params[0], &raw)
+		if c.received++; c.reject > 0 && c.received%c.reject == 0 {
+			res["error"] = map[string]interface{}{"code": -32000, "message": "nonce too low"}
+			break
+		}
+		enc, _ := hexutil.Decode(raw)
+		c.pool = append(c.pool, common.BytesToHash(enc))
+		res["result"] = raw
+	case "eth_blockNumber":
+		c.blocks = append(c.blocks, c.pool)
+		c.pool = nil
+		res["result"] = hexutil.EncodeUint64(uint64(len(c.blocks)))
+	case "eth_getBlockByNumber":
+		var number hexutil.Uint64
+		json.Unmarshal(req.Params[0], &number)
+		res["result"] = map[string]interface{}{"transactions": c.blocks[number-1]}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func TestLoadRun(t *testing.T) {
+	chain := &fakeChain{reject: 5}
+	srv := httptest.NewServer(chain)
+	defer srv.Close()
+
+	opts := &LoadOptions{
+		StatusOptions: StatusOptions{Interval: 5 * time.Millisecond},
+		TPS:           500,
+		Concurrency:   2,
+		Duration:      time.Minute,
+		Count:         50,
+		Settle:        time.Second,
+	}
+	client, err := rpc.DialHTTP(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := newLoadRun(opts, []*rpc.Client{client}, nil)
+	for i := 0; i < 3; i++ {
+		run.senders = append(run.senders, &loadSender{address: common.BytesToAddress([]byte{byte(i + 1)})})
+	}
+	// the raw transaction is its own hash, made of the sender and nonce
+	run.sign = func(from *loadSender, nonce uint64, to common.Address, data []byte) ([]byte, common.Hash, error) {
+		raw := make([]byte, 32)
+		copy(raw, from.address[19:])
+		binary.BigEndian.PutUint64(raw[24:], nonce)
+		return raw, common.BytesToHash(raw), nil
+	}
+
+	if err := run.prepare(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	report, err := run.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sent+report.Failed != 50 || report.Failed != 10 {
+		t.Fatalf("expect 40 sent and 10 failed, got %d and %d", report.Sent, report.Failed)
+	}
+	if report.Included != report.Sent || len(report.Latencies) != report.Sent {
+		t.Fatalf("expect all %d included, got %d", report.Sent, report.Included)
+	}
+
+	buf := new(bytes.Buffer)
+	printLoadReport(buf, report)
+	for _, expect := range []string{"sent 40, failed 10, included 40 (100.0%)", "latency p50", `failure "nonce too low": 10`} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expect %q in report:\n%s", expect, buf.String())
+		}
+	}
+}
+
+func TestLoadRunSlowNode(t *testing.T) {
+	srv := httptest.NewServer(&fakeChain{delay: 200 * time.Millisecond})
+	defer srv.Close()
+	client, err := rpc.DialHTTP(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &LoadOptions{
+		StatusOptions: StatusOptions{Interval: 5 * time.Millisecond},
+		TPS:           1000,
+		Duration:      100 * time.Millisecond,
+		Settle:        10 * time.Millisecond,
+	}
+	run := newLoadRun(opts, []*rpc.Client{client}, nil)
+	run.senders = append(run.senders, &loadSender{address: common.BytesToAddress([]byte{1})})
+	run.sign = func(from *loadSender, nonce uint64, to common.Address, data []byte) ([]byte, common.Hash, error) {
+		raw := make([]byte, 32)
+		binary.BigEndian.PutUint64(raw[24:], nonce)
+		return raw, common.BytesToHash(raw), nil
+	}
+	if err := run.prepare(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the duration is kept although the only worker is blocked by the node
+	start := time.Now()
+	report, err := run.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("run should stop after the duration, took %s", elapsed)
+	}
+	if report.Dropped == 0 {
+		t.Fatal("ticks should be dropped while the worker is busy")
+	}
+
+	// so is the cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	opts.Duration = time.Minute
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	if _, err := run.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("run should stop on cancel, took %s", elapsed)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	list := make([]time.Duration, 0, 100)
+	for i := 1; i <= 100; i++ {
+		list = append(list, time.Duration(i))
+	}
+	for p, expect := range map[float64]time.Duration{0.5: 50, 0.9: 90, 0.99: 99, 1: 100} {
+		if got := percentile(list, p); got != expect {
+			t.Errorf("p%v: expect %d, got %d", p*100, expect, got)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("expect 0 for empty list, got %s", fmt.Sprint(got))
+	}
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	manifestFile    = "MANIFEST.json"
+	manifestSigFile = "MANIFEST.json.sig"
+	genesisHashFile = "genesis.hash"
+)
+
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest lists every generated public file of a network with its checksum, secrets such as
+// node keys are never listed.
+type Manifest struct {
+	ChainID          uint64          `json:"chainId"`
+	GenesisHash      common.Hash     `json:"genesisHash"`
+	GenesisStateRoot common.Hash     `json:"genesisStateRoot"`
+	Files            []*ManifestFile `json:"files"`
+}
+
+// GenesisInfo denotes the identity of the genesis block, nodes initialized with the same
+// genesis file are on the same chain only if these values are equal.
+type GenesisInfo struct {
+	Hash      common.Hash
+	StateRoot common.Hash
+}
+
+// ComputeGenesisInfo builds the genesis block against an in-memory database, which is exactly
+// what `geth init` does, and returns its hash and state root.
+func ComputeGenesisInfo(genesis *core.Genesis) *GenesisInfo {
+	block := genesis.ToBlock(rawdb.NewMemoryDatabase())
+	return &GenesisInfo{
+		Hash:      block.Hash(),
+		StateRoot: block.Root(),
+	}
+}
+
+func fileSHA256(p string) (string, int64, error) {
+	enc, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", 0, err
+	}
+	sum := sha256.Sum256(enc)
+	return hex.EncodeToString(sum[:]), int64(len(enc)), nil
+}
+
+// publicFiles returns the relative path of all public artifacts in the network directory.
+func publicFiles(dir string) ([]string, error) {
+	list := make([]string, 0)
+	for _, name := range existingArtifacts(dir) {
+		if name == manifestFile || name == manifestSigFile {
+			continue
+		}
+		err := filepath.Walk(path.Join(dir, name), func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || isSecret(dir, p, info) {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			list = append(list, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// manifestData returns the manifest of the genesis and files, and its content.
+func manifestData(info *GenesisInfo, entries []*ManifestFile) (*Manifest, []byte, error) {
+	manifest := &Manifest{
+		ChainID:          config.Conf.ChainID,
+		GenesisHash:      info.Hash,
+		GenesisStateRoot: info.StateRoot,
+		Files:            entries,
+	}
+	enc, err := json.MarshalIndent(manifest, "", "\t")
+	return manifest, enc, err
+}
+
+// saveManifest write `MANIFEST.json` of the network in dir, and a detached signature in
+// `MANIFEST.json.sig` if the operator key is configured, otherwise a signature of the previous
+// manifest is removed.
+func saveManifest(dir string, info *GenesisInfo) error {
+	list, err := publicFiles(dir)
+	if err != nil {
+		return err
+	}
+	entries := make([]*ManifestFile, 0, len(list))
+	for _, rel := range list {
+		sum, size, err := fileSHA256(path.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &ManifestFile{Path: rel, Size: size, SHA256: sum})
+	}
+
+	manifest, enc, err := manifestData(info, entries)
+	if err != nil {
+		return err
+	}
+	if err := files.WriteFileAtomic(path.Join(dir, manifestFile), enc, files.PublicFileMode); err != nil {
+		return err
+	}
+	log.Infof("manifest with %d files saved, genesis hash %s", len(manifest.Files), manifest.GenesisHash.Hex())
+
+	if config.Conf.OperatorKey == "" {
+		if err := os.Remove(path.Join(dir, manifestSigFile)); err == nil {
+			warnf("manifest changed and is no longer signed, the previous signature removed")
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	key, err := crypto.LoadECDSA(config.Conf.OperatorKey)
+	if err != nil {
+		return fmt.Errorf("load operator key failed, err: %v", err)
+	}
+	sig, err := crypto.Sign(crypto.Keccak256(enc), key)
+	if err != nil {
+		return err
+	}
+	if err := files.WriteFileAtomic(path.Join(dir, manifestSigFile), []byte(hexutil.Encode(sig)), files.PublicFileMode); err != nil {
+		return err
+	}
+	log.Infof("manifest signed by operator %s", crypto.PubkeyToAddress(key.PublicKey).Hex())
+	return nil
+}
+
+// operatorAddress returns the trusted manifest signer, which is the configured operator address
+// or the address of the configured operator key.
+func operatorAddress() (common.Address, bool, error) {
+	if config.Conf.OperatorAddress != "" {
+		if !common.IsHexAddress(config.Conf.OperatorAddress) {
+			return common.Address{}, false, fmt.Errorf("invalid operator address %s", config.Conf.OperatorAddress)
+		}
+		return common.HexToAddress(config.Conf.OperatorAddress), true, nil
+	}
+	if config.Conf.OperatorKey != "" {
+		key, err := crypto.LoadECDSA(config.Conf.OperatorKey)
+		if err != nil {
+			return common.Address{}, false, fmt.Errorf("load operator key failed, err: %v", err)
+		}
+		return crypto.PubkeyToAddress(key.PublicKey), true, nil
+	}
+	return common.Address{}, false, nil
+}
+
+// checkManifestSig checks the detached signature of the manifest content, which must be made by the
+// configured operator. a manifest without signature passes only if no operator is configured.
+func checkManifestSig(dir string, enc []byte) error {
+	trusted, ok, err := operatorAddress()
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(path.Join(dir, manifestSigFile))
+	if os.IsNotExist(err) {
+		if ok {
+			return fmt.Errorf("manifest is not signed, expect a signature of operator %s", trusted.Hex())
+		}
+		log.Warn("manifest is not signed")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sig, err := hexutil.Decode(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return fmt.Errorf("invalid manifest signature, err: %v", err)
+	}
+	pub, err := crypto.SigToPub(crypto.Keccak256(enc), sig)
+	if err != nil {
+		return fmt.Errorf("invalid manifest signature, err: %v", err)
+	}
+	signer := crypto.PubkeyToAddress(*pub)
+	if !ok {
+		return fmt.Errorf("manifest signed by %s, configure OperatorAddress to check the signer", signer.Hex())
+	}
+	if signer != trusted {
+		return fmt.Errorf("manifest signed by %s, expect operator %s", signer.Hex(), trusted.Hex())
+	}
+	log.Infof("manifest signature of operator %s verified", signer.Hex())
+	return nil
+}
+
+// checkManifestPath rejects a listed path which points outside the network directory.
+func checkManifestPath(rel string) error {
+	if rel == "" || path.IsAbs(rel) || filepath.IsAbs(rel) || strings.Contains(rel, "\\") {
+		return fmt.Errorf("invalid path %q in manifest", rel)
+	}
+	for _, elem := range strings.Split(rel, "/") {
+		if elem == ".." {
+			return fmt.Errorf("invalid path %q in manifest", rel)
+		}
+	}
+	return nil
+}
+
+// VerifyManifest checks the signature of `MANIFEST.json` first, which must exist and be made by the
+// operator if one is configured, then the files of the network against the manifest. an error is
+// returned on the first mismatch.
+func VerifyManifest(dir string) error {
+	env = path.Join(folder, dir)
+
+	enc, err := ioutil.ReadFile(path.Join(env, manifestFile))
+	if err != nil {
+		return fmt.Errorf("read manifest failed, err: %v", err)
+	}
+	if err := checkManifestSig(env, enc); err != nil {
+		return err
+	}
+	manifest := new(Manifest)
+	if err := json.Unmarshal(enc, manifest); err != nil {
+		return fmt.Errorf("invalid manifest, err: %v", err)
+	}
+
+	listed := make(map[string]bool)
+	for _, v := range manifest.Files {
+		if err := checkManifestPath(v.Path); err != nil {
+			return err
+		}
+		listed[v.Path] = true
+		sum, size, err := fileSHA256(path.Join(env, v.Path))
+		if err != nil {
+			return err
+		}
+		if sum != v.SHA256 || size != v.Size {
+			return fmt.Errorf("file %s modified, expect sha256 %s got %s", v.Path, v.SHA256, sum)
+		}
+	}
+	list, err := publicFiles(env)
+	if err != nil {
+		return err
+	}
+	for _, rel := range list {
+		if !listed[rel] {
+			log.Warnf("file %s is not listed in manifest", rel)
+		}
+	}
+
+	info, err := fileGenesisInfo(path.Join(env, "genesis.json"))
+	if err != nil {
+		return err
+	}
+	if info.Hash != manifest.GenesisHash {
+		return fmt.Errorf("genesis hash mismatch, expect %s got %s", manifest.GenesisHash.Hex(), info.Hash.Hex())
+	}
+	if info.StateRoot != manifest.GenesisStateRoot {
+		return fmt.Errorf("genesis state root mismatch, expect %s got %s", manifest.GenesisStateRoot.Hex(), info.StateRoot.Hex())
+	}
+	log.Infof("%d files match manifest, genesis hash %s", len(manifest.Files), manifest.GenesisHash.Hex())
+	return nil
+}
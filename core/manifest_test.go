@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestVerifyManifestSignature(t *testing.T) {
+	dir := generateTestNetwork(t, 4)
+	if err := VerifyManifest("test"); err != nil {
+		t.Fatalf("unsigned manifest without operator: %v", err)
+	}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "..", "operator.key")
+	if err := crypto.SaveECDSA(keyFile, key); err != nil {
+		t.Fatal(err)
+	}
+	config.Conf.OperatorKey = keyFile
+	if err := VerifyManifest("test"); err == nil || !strings.Contains(err.Error(), "manifest is not signed") {
+		t.Fatalf("unsigned manifest with operator: expect err, got %v", err)
+	}
+
+	manifest := new(Manifest)
+	if err := files.ReadJsonFile(path.Join(dir, manifestFile), manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveManifest(dir, &GenesisInfo{Hash: manifest.GenesisHash, StateRoot: manifest.GenesisStateRoot}); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest("test"); err != nil {
+		t.Fatalf("signed manifest: %v", err)
+	}
+
+	// a removed signature does not turn the manifest into an unsigned one
+	if err := os.Remove(path.Join(dir, manifestSigFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest("test"); err == nil {
+		t.Fatal("expect err on removed signature")
+	}
+}
+
+func TestVerifyManifestPaths(t *testing.T) {
+	dir := generateTestNetwork(t, 4)
+	enc, err := ioutil.ReadFile(path.Join(dir, manifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"/etc/passwd", "../../outside", "nodes/../../outside", ""} {
+		manifest := new(Manifest)
+		if err := json.Unmarshal(enc, manifest); err != nil {
+			t.Fatal(err)
+		}
+		manifest.Files = append(manifest.Files, &ManifestFile{Path: rel})
+		crafted, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, manifestFile), crafted, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyManifest("test"); err == nil || !strings.Contains(err.Error(), "invalid path") {
+			t.Errorf("path %q: expect invalid path, got %v", rel, err)
+		}
+	}
+}
+
+func TestRunOperatorKeyError(t *testing.T) {
+	generateTestNetwork(t, 4)
+	config.Conf.OperatorKey = "missing.key"
+	err := Run("other", 4, config.Conf.InitBalance, AbortIfExist)
+	if err == nil || !strings.Contains(err.Error(), "load operator key failed") {
+		t.Fatalf("expect the operator key error returned, got %v", err)
+	}
+}
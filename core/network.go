@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/dylenfu/zion-makeup/pkg/supervisor"
+)
+
+// ExistPolicy denotes how to deal with a network which already generated in `build/<env>`.
+type ExistPolicy int
+
+const (
+	AbortIfExist ExistPolicy = iota
+	ForceOverwrite
+	BackupExisting
+)
+
+// networkArtifacts lists the generated entries of a network directory, other files such as the
+// config and the setup binary which placed in `build/<env>` by the makefile, and the datadirs of a
+// launched network, are left untouched.
+var networkArtifacts = []string{
+	"nodes",
+	"genesis.json",
+	genesisHashFile,
+	"static-nodes.json",
+	"extra.dat",
+	"alloc-nodes.json",
+	"minerlist.sh",
+	bundleFolder,
+	changesFolder,
+	archiveFolder,
+	manifestFile,
+	manifestSigFile,
+}
+
+func existingArtifacts(dir string) []string {
+	list := make([]string, 0)
+	for _, name := range networkArtifacts {
+		if _, err := os.Stat(path.Join(dir, name)); err == nil {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+func checkExistingNetwork(dir string, policy ExistPolicy) error {
+	existing := existingArtifacts(dir)
+	if len(existing) == 0 || policy != AbortIfExist {
+		return nil
+	}
+	return fmt.Errorf("network already exists in %s (%s), use -force to overwrite it or -backup to keep a copy",
+		dir, strings.Join(existing, ", "))
+}
+
+// checkNotRunning refuses to replace a network which is launched by `up` on this host.
+func checkNotRunning(dir string) error {
+	if pid, ok, err := supervisor.ReadPid(runPath(dir, upPidFile)); err == nil && ok {
+		return fmt.Errorf("network in %s is up, pid %d, run `down` first", dir, pid)
+	}
+	return nil
+}
+
+// newStaging create a temporary directory next to the target, all files of a new network are written
+// there and only moved into the target after the whole network generated.
+func newStaging(dir string) (string, error) {
+	parent, name := path.Split(dir)
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(parent, "."+name+"-staging-")
+}
+
+// uniqueDir returns prefix, or prefix with a counter if it exists, so that backups made within the
+// same second don't collide.
+func uniqueDir(prefix string) string {
+	p := prefix
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p
+		}
+		p = fmt.Sprintf("%s-%d", prefix, i)
+	}
+}
+
+func isArtifact(name string) bool {
+	for _, v := range networkArtifacts {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// swapNetwork moves target aside to old and renames staging into its place, so the network in target
+// is either the old or the new one. entries of old which are not network artifacts are moved back.
+func swapNetwork(staging, target, old string) error {
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(staging, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(target, old); err != nil {
+		return fmt.Errorf("move %s aside failed, err: %v", target, err)
+	}
+	if err := os.Rename(staging, target); err != nil {
+		if err := os.Rename(old, target); err != nil {
+			log.Errorf("restore %s from %s failed, err: %v", target, old, err)
+		}
+		return fmt.Errorf("move %s into place failed, err: %v", target, err)
+	}
+
+	entries, err := ioutil.ReadDir(old)
+	if err != nil {
+		return err
+	}
+	for _, v := range entries {
+		if isArtifact(v.Name()) {
+			continue
+		}
+		if err := os.Rename(path.Join(old, v.Name()), path.Join(target, v.Name())); err != nil {
+			return fmt.Errorf("move %s back from %s failed, err: %v", v.Name(), old, err)
+		}
+	}
+	return nil
+}
+
+// commitNetwork move the staged network into the target directory. an existing network is removed
+// or kept in `<target>.backup-<timestamp>` according to the policy.
+func commitNetwork(staging, target string, policy ExistPolicy) error {
+	if err := checkNotRunning(target); err != nil {
+		return err
+	}
+	if err := checkExistingNetwork(target, policy); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		if err := os.Chmod(staging, files.PublicDirMode); err != nil {
+			return err
+		}
+		return os.Rename(staging, target)
+	}
+
+	existed := len(existingArtifacts(target)) > 0
+	backup := existed && policy == BackupExisting
+
+	old := staging + "-old"
+	if backup {
+		old = uniqueDir(fmt.Sprintf("%s.backup-%s", target, time.Now().Format("20060102-150405")))
+	}
+	if err := swapNetwork(staging, target, old); err != nil {
+		return err
+	}
+
+	if backup {
+		log.Infof("existing network moved to %s", old)
+		return nil
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return fmt.Errorf("remove %s failed, err: %v", old, err)
+	}
+	if existed {
+		warnf("existing network in %s overwritten", target)
+	}
+	if _, err := os.Stat(runPath(target)); err == nil {
+		warnf("datadirs in %s are initialized with the previous network, remove them before `up`", runPath(target))
+	}
+	return nil
+}
+
+// cloneTree recreates the directories of src in dst and hard links the files, which falls back to a
+// copy if links are not supported.
+func cloneTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		}
+		if err := os.Link(p, target); err == nil {
+			return nil
+		}
+		enc, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, enc, info.Mode().Perm())
+	})
+}
+
+// stageNetwork clones the network in dir into a new staging directory, in which a change is made
+// and then moved into place by commitChange. files are shared with dir through hard links, so they
+// must be replaced with `files.WriteFileAtomic` or renamed rather than written in place.
+func stageNetwork(dir string) (string, error) {
+	staging, err := newStaging(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range existingArtifacts(dir) {
+		if err := cloneTree(path.Join(dir, name), path.Join(staging, name)); err != nil {
+			os.RemoveAll(staging)
+			return "", fmt.Errorf("stage %s failed, err: %v", name, err)
+		}
+	}
+	return staging, nil
+}
+
+// commitChange moves the changed network in staging into the place of dir, the old one is removed.
+func commitChange(staging, dir string) error {
+	if err := checkNotRunning(dir); err != nil {
+		return err
+	}
+	old := staging + "-old"
+	if err := swapNetwork(staging, dir, old); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/dylenfu/zion-makeup/pkg/files"
+)
+
+func writeTestFile(t *testing.T, p, content string) {
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, p string) string {
+	enc, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(enc)
+}
+
+func TestCommitNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zion-makeup-commit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "local")
+
+	commit := func(version string, policy ExistPolicy) error {
+		staging, err := newStaging(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(staging)
+		writeTestFile(t, path.Join(staging, "genesis.json"), version)
+		writeTestFile(t, path.Join(staging, "nodes", "node0", "nodekey"), version)
+		return commitNetwork(staging, target, policy)
+	}
+
+	if err := commit("v1", AbortIfExist); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path.Join(target, "config.json"), "config")
+	if err := commit("v2", AbortIfExist); err == nil {
+		t.Fatal("existing network should not be overwritten")
+	}
+	if err := commit("v2", BackupExisting); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit("v3", BackupExisting); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit("v4", ForceOverwrite); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readTestFile(t, path.Join(target, "nodes", "node0", "nodekey")); got != "v4" {
+		t.Fatalf("expect v4 in target, got %s", got)
+	}
+	if got := readTestFile(t, path.Join(target, "config.json")); got != "config" {
+		t.Fatalf("config should be kept, got %s", got)
+	}
+
+	backups, err := filepath.Glob(target + ".backup-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expect 2 backups, got %v", backups)
+	}
+	versions := make(map[string]bool)
+	for _, v := range backups {
+		versions[readTestFile(t, path.Join(v, "genesis.json"))] = true
+		if _, err := os.Stat(path.Join(v, "config.json")); !os.IsNotExist(err) {
+			t.Errorf("config should not be moved to backup %s", v)
+		}
+	}
+	if !versions["v1"] || !versions["v2"] {
+		t.Fatalf("expect v1 and v2 backups, got %v", versions)
+	}
+
+	left, err := filepath.Glob(path.Join(dir, ".*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("staging or old directories left behind %v", left)
+	}
+}
+
+func TestStageNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zion-makeup-stage-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "local")
+	writeTestFile(t, path.Join(target, "nodes", "node0", "nodekey"), "v1")
+	writeTestFile(t, path.Join(target, "static-nodes.json"), "v1")
+	writeTestFile(t, path.Join(target, "config.json"), "config")
+
+	staging, err := stageNetwork(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(staging)
+	if _, err := os.Stat(path.Join(staging, "config.json")); !os.IsNotExist(err) {
+		t.Fatal("only network artifacts should be staged")
+	}
+	if err := files.WriteFileAtomic(path.Join(staging, "nodes", "node0", "nodekey"), []byte("v2"), files.SecretFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, path.Join(target, "nodes", "node0", "nodekey")); got != "v1" {
+		t.Fatalf("staged change leaked into the network, got %s", got)
+	}
+
+	if err := commitChange(staging, target); err != nil {
+		t.Fatal(err)
+	}
+	for name, expect := range map[string]string{
+		"nodes/node0/nodekey": "v2",
+		"static-nodes.json":   "v1",
+		"config.json":         "config",
+	} {
+		if got := readTestFile(t, path.Join(target, name)); got != expect {
+			t.Errorf("%s: expect %s, got %s", name, expect, got)
+		}
+	}
+}
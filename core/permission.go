@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+)
+
+// applyOwnership change the owner of all generated artifacts in dir to the configured uid and gid.
+func applyOwnership(dir string) error {
+	if config.Conf.Uid == nil && config.Conf.Gid == nil {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if config.Conf.Uid != nil {
+		uid = *config.Conf.Uid
+	}
+	if config.Conf.Gid != nil {
+		gid = *config.Conf.Gid
+	}
+
+	for _, name := range existingArtifacts(dir) {
+		err := filepath.Walk(path.Join(dir, name), func(p string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(p, uid, gid)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("artifacts in %s owned by uid %d gid %d", dir, uid, gid)
+	return nil
+}
+
+// isSecret denotes whether the file or directory holds private key material.
+func isSecret(dir, p string, info os.FileInfo) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	switch {
+	case info.IsDir():
+		matched, _ := path.Match("nodes/node*", rel)
+		return matched || rel == bundleFolder || rel == archiveFolder || strings.HasPrefix(rel, archiveFolder+"/")
+	case path.Base(rel) == "nodekey":
+		return true
+	case path.Dir(rel) == bundleFolder:
+		return true
+	}
+	return false
+}
+
+// Verify walks the network of the environment and warns about secrets which are readable by
+// the group or others, and about a network directory which others can write to. it returns the
+// number of insecure files and directories.
+func Verify(dir string) (int, error) {
+	env = path.Join(folder, dir)
+
+	insecure := 0
+	info, err := os.Stat(env)
+	if err != nil {
+		return 0, err
+	}
+	if mode := info.Mode().Perm(); mode&0022 != 0 {
+		insecure++
+		log.Warnf("network directory %s is writable by group or others, mode %#o", env, mode)
+	}
+	for _, name := range existingArtifacts(env) {
+		err := filepath.Walk(path.Join(env, name), func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !isSecret(env, p, info) {
+				return nil
+			}
+			if mode := info.Mode().Perm(); mode&0077 != 0 {
+				insecure++
+				log.Warnf("secret %s is accessible by group or others, mode %#o", p, mode)
+			}
+			return nil
+		})
+		if err != nil {
+			return insecure, err
+		}
+	}
+
+	if insecure == 0 {
+		log.Infof("all secrets in %s are only accessible by the owner", env)
+	}
+	return insecure, nil
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/dylenfu/zion-makeup/config"
+)
+
+func TestIsSecret(t *testing.T) {
+	dir := generateTestNetwork(t, 4)
+	for rel, expect := range map[string]bool{
+		"nodes/node0/nodekey": true,
+		"nodes/node0":         true,
+		"nodes/node0/pubkey":  false,
+		"nodes":               false,
+		"genesis.json":        false,
+		"static-nodes.json":   false,
+	} {
+		p := path.Join(dir, rel)
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isSecret(dir, p, info); got != expect {
+			t.Errorf("%s: secret %v, expect %v", rel, got, expect)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := generateTestNetwork(t, 4)
+	if insecure, err := Verify("test"); err != nil || insecure != 0 {
+		t.Fatalf("generated network: %d insecure, err %v", insecure, err)
+	}
+
+	if err := os.Chmod(path.Join(dir, "nodes", "node0", "nodekey"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if insecure, err := Verify("test"); err != nil || insecure != 1 {
+		t.Fatalf("readable nodekey: %d insecure, err %v", insecure, err)
+	}
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if insecure, err := Verify("test"); err != nil || insecure != 2 {
+		t.Fatalf("writable network directory: %d insecure, err %v", insecure, err)
+	}
+}
+
+func TestApplyOwnership(t *testing.T) {
+	dir := generateTestNetwork(t, 4)
+	uid, gid := os.Getuid(), os.Getgid()
+	config.Conf.Uid, config.Conf.Gid = &uid, &gid
+	if err := applyOwnership(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyOwnership(path.Join(dir, "missing")); err != nil {
+		t.Fatalf("no artifacts to own: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+)
+
+// Endpoint denotes the p2p address assigned to a node.
+type Endpoint struct {
+	Host string
+	Port int
+}
+
+// placeNodes assigns n nodes to the hosts of `IpList`. without host labels each host holds a
+// contiguous range of nodes in order, and the first hosts take one more if n is not a multiple of
+// the hosts number. with host labels nodes are spread over the failure domains, see `pickHost`.
+// ports on a host start from `StartPort`.
+func placeNodes(n int) []*Endpoint {
+	ips := config.Conf.IpList
+	list := make([]*Endpoint, 0, n)
+	if len(ips) == 0 || n <= 0 {
+		return list
+	}
+
+	if len(config.Conf.HostLabels) > 0 {
+		count := make(map[string]int)
+		for i := 0; i < n; i++ {
+			host := pickHost(count)
+			list = append(list, &Endpoint{Host: host, Port: config.Conf.StartPort + count[hostDomain(host)]})
+			for _, d := range failureDomains(host) {
+				count[d]++
+			}
+		}
+		return list
+	}
+
+	per, rem := n/len(ips), n%len(ips)
+	for k, ip := range ips {
+		count := per
+		if k < rem {
+			count++
+		}
+		for j := 0; j < count; j++ {
+			list = append(list, &Endpoint{Host: ip, Port: config.Conf.StartPort + j})
+		}
+	}
+	return list
+}
+
+func hostDomain(host string) string {
+	return "host=" + host
+}
+
+// labelOrder lists the well known label keys from the widest domain to the narrowest, other keys
+// follow them in alphabetical order.
+var labelOrder = []string{"provider", "region", "zone", "rack"}
+
+func labelRank(key string) int {
+	for i, v := range labelOrder {
+		if v == key {
+			return i
+		}
+	}
+	return len(labelOrder)
+}
+
+// failureDomains returns the domains which fail together with the host, they are the host itself
+// and one domain for each of its labels. a label is scoped under the wider ones, e.g. `zone=a` and
+// `zone=a/rack=r1`, so that racks of the same name in different zones are different domains.
+func failureDomains(host string) []string {
+	labels := config.Conf.HostLabels[host]
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if ri, rj := labelRank(keys[i]), labelRank(keys[j]); ri != rj {
+			return ri < rj
+		}
+		return keys[i] < keys[j]
+	})
+
+	domains := []string{hostDomain(host)}
+	scope := ""
+	for _, k := range keys {
+		scope += k + "=" + labels[k]
+		domains = append(domains, scope)
+		scope += "/"
+	}
+	return domains
+}
+
+// pickHost returns the host whose failure domains hold the fewest nodes. the node counts of the
+// domains of each host are sorted in descending order and compared one by one, so that nodes
+// are spread over the widest domains such as zones first, then racks and hosts.
+func pickHost(count map[string]int) string {
+	var (
+		best      string
+		bestScore []int
+	)
+	for _, ip := range config.Conf.IpList {
+		score := make([]int, 0)
+		for _, d := range failureDomains(ip) {
+			score = append(score, count[d])
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(score)))
+		if best == "" || lessScore(score, bestScore) {
+			best, bestScore = ip, score
+		}
+	}
+	return best
+}
+
+func lessScore(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// hostNodesOf returns the placement as nodes numbered in order, without keys.
+func hostNodesOf(placement []*Endpoint) []*HostNode {
+	list := make([]*HostNode, 0, len(placement))
+	for i, v := range placement {
+		list = append(list, &HostNode{Index: i, Host: v.Host, Port: v.Port})
+	}
+	return list
+}
+
+// endpointsOf returns the placement of the nodes.
+func endpointsOf(list []*HostNode) []*Endpoint {
+	placement := make([]*Endpoint, 0, len(list))
+	for _, v := range list {
+		placement = append(placement, &Endpoint{Host: v.Host, Port: v.Port})
+	}
+	return placement
+}
+
+// checkFailureDomains prints the placement of every host and warns about the failure domains which
+// hold more than f validators, the chain halts if such a domain fails. a single host is already
+// warned by `CheckFaultTolerance` and its domains are not checked.
+func checkFailureDomains(list []*HostNode) {
+	f := FaultTolerance(len(list))
+
+	nodes := make(map[string][]string)
+	count := make(map[string]int)
+	for _, v := range list {
+		nodes[v.Host] = append(nodes[v.Host], fmt.Sprintf("node%d:%d", v.Index, v.Port))
+		for _, d := range failureDomains(v.Host) {
+			count[d]++
+		}
+	}
+	for _, host := range config.Conf.IpList {
+		log.Infof("host %s %v: %s", host, failureDomains(host)[1:], strings.Join(nodes[host], " "))
+	}
+	if len(nodes) < 2 {
+		return
+	}
+
+	domains := make([]string, 0, len(count))
+	for d := range count {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		if count[d] > f {
+			warnf("failure domain %s holds %d validators, more than the %d faulty tolerated", d, count[d], f)
+		}
+	}
+}
+
+func nodesPerHost(placement []*Endpoint) map[string]int {
+	count := make(map[string]int)
+	for _, v := range placement {
+		count[v.Host]++
+	}
+	return count
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dylenfu/zion-makeup/config"
+)
+
+func TestFailureDomains(t *testing.T) {
+	conf := *config.Conf
+	defer func() { config.Conf = &conf }()
+	config.Conf.IpList = []string{"10.0.0.1", "10.0.0.2", "10.0.1.1"}
+	config.Conf.HostLabels = map[string]map[string]string{
+		"10.0.0.1": {"zone": "a", "rack": "r1"},
+		"10.0.0.2": {"zone": "a", "rack": "r2"},
+		"10.0.1.1": {"zone": "b", "rack": "r1", "pdu": "p1"},
+	}
+
+	expect := []string{"host=10.0.1.1", "zone=b", "zone=b/rack=r1", "zone=b/rack=r1/pdu=p1"}
+	if got := failureDomains("10.0.1.1"); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, got %v", expect, got)
+	}
+
+	// rack r1 of zone a and zone b are different domains, so 4 nodes fill every rack and zone b
+	// takes 2 of them
+	count := make(map[string]int)
+	for _, v := range placeNodes(4) {
+		for _, d := range failureDomains(v.Host) {
+			count[d]++
+		}
+	}
+	for d, expect := range map[string]int{"zone=a": 2, "zone=b": 2, "zone=a/rack=r1": 1, "zone=b/rack=r1": 2} {
+		if count[d] != expect {
+			t.Errorf("%s: expect %d nodes, got %d", d, expect, count[d])
+		}
+	}
+}
@@ -0,0 +1,351 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	PlanCreate    = "create"
+	PlanChange    = "change"
+	PlanRemove    = "remove"
+	PlanBackup    = "backup"
+	PlanUnchanged = "unchanged"
+)
+
+// PlanFile denotes a file of the network and what `generate` would do to it.
+type PlanFile struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Secret bool   `json:"secret,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// PlanPlacement denotes a node and the endpoint it is placed at.
+type PlanPlacement struct {
+	*PlanNode
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// PlanHost denotes the nodes placed on a host and their ports.
+type PlanHost struct {
+	Host  string `json:"host"`
+	Nodes []int  `json:"nodes"`
+	Ports []int  `json:"ports"`
+}
+
+// GeneratePlan is the result of a dry run of `generate`, the network is generated in memory and
+// compared with the files on disk.
+type GeneratePlan struct {
+	Dir            string           `json:"dir"`
+	Exists         bool             `json:"exists"`
+	Policy         string           `json:"policy"`
+	ChainID        uint64           `json:"chainId"`
+	GenesisHash    *common.Hash     `json:"genesisHash,omitempty"`
+	FaultTolerance int              `json:"faultTolerance"`
+	QuorumSize     int              `json:"quorumSize"`
+	Nodes          []*PlanPlacement `json:"nodes"`
+	Hosts          []*PlanHost      `json:"hosts"`
+	Files          []*PlanFile      `json:"files"`
+	Warnings       []string         `json:"warnings"`
+}
+
+func policyName(policy ExistPolicy) string {
+	switch policy {
+	case ForceOverwrite:
+		return "overwrite"
+	case BackupExisting:
+		return "backup"
+	}
+	return "abort"
+}
+
+// plannedFile is a generated file kept in memory, the data of secrets is never kept.
+type plannedFile struct {
+	data   []byte
+	secret bool
+	note   string
+}
+
+// artifactLess orders paths as the network directory is walked, by artifact and then by name.
+func artifactLess(a, b string) bool {
+	index := func(p string) int {
+		top := strings.SplitN(p, "/", 2)[0]
+		for i, v := range networkArtifacts {
+			if v == top {
+				return i
+			}
+		}
+		return len(networkArtifacts)
+	}
+	if ia, ib := index(a), index(b); ia != ib {
+		return ia < ib
+	}
+	return a < b
+}
+
+func sortedPaths(m map[string]*plannedFile) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return artifactLess(list[i], list[j]) })
+	return list
+}
+
+// diskFiles returns the files of the existing network in dir relative to it.
+func diskFiles(dir string) (map[string]bool, error) {
+	found := make(map[string]bool)
+	for _, name := range existingArtifacts(dir) {
+		err := filepath.Walk(path.Join(dir, name), func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err == nil {
+				found[filepath.ToSlash(rel)] = true
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// planFiles runs the generate pipeline in memory and returns the files it would write.
+func planFiles(sortedNodes []*Node, initAllocBalance string) (map[string]*plannedFile, *GenesisInfo, error) {
+	planned := make(map[string]*plannedFile)
+	for i, v := range sortedNodes {
+		nodeDir := fmt.Sprintf("nodes/node%d", i)
+		planned[nodeDir+"/nodekey"] = &plannedFile{secret: true}
+		planned[nodeDir+"/pubkey"] = &plannedFile{data: []byte(v.PubKeyHex())}
+	}
+
+	nodesMap, extra, err := genesisAlloc(sortedNodes, initAllocBalance)
+	if err != nil {
+		return nil, nil, err
+	}
+	var info *GenesisInfo
+	if conf := config.Conf.StateDump; conf != nil {
+		note := fmt.Sprintf("seeded from state dump %s, not computed in dry run", conf.Path)
+		planned["genesis.json"] = &plannedFile{note: note}
+		planned[genesisHashFile] = &plannedFile{note: note}
+		planned[manifestFile] = &plannedFile{note: note}
+	} else {
+		data, genesis, err := genesisData(nodesMap, extra)
+		if err != nil {
+			return nil, nil, err
+		}
+		info = genesis
+		planned["genesis.json"] = &plannedFile{data: data}
+		planned[genesisHashFile] = &plannedFile{data: []byte(info.Hash.Hex() + "\n")}
+	}
+
+	static, err := staticNodesData(sortedNodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	planned["static-nodes.json"] = &plannedFile{data: static}
+
+	if info != nil {
+		entries := make([]*ManifestFile, 0)
+		for _, rel := range sortedPaths(planned) {
+			if v := planned[rel]; !v.secret {
+				sum := sha256.Sum256(v.data)
+				entries = append(entries, &ManifestFile{Path: rel, Size: int64(len(v.data)), SHA256: hex.EncodeToString(sum[:])})
+			}
+		}
+		_, enc, err := manifestData(info, entries)
+		if err != nil {
+			return nil, nil, err
+		}
+		planned[manifestFile] = &plannedFile{data: enc}
+	}
+	if config.Conf.OperatorKey != "" {
+		planned[manifestSigFile] = &plannedFile{note: "signed with the operator key, not computed in dry run"}
+	}
+	return planned, info, nil
+}
+
+// PlanGenerate runs `generate` in memory and compares the result with the network in `build/<dir>`,
+// nothing is written and the generated keys never leave memory.
+func PlanGenerate(dir string, n int, initAllocBalance string, policy ExistPolicy) (*GeneratePlan, error) {
+	resetWarnings()
+	target := path.Join(folder, dir)
+	placement := placeNodes(n)
+	if err := CheckFaultTolerance(n, placement); err != nil {
+		return nil, err
+	}
+	checkFailureDomains(hostNodesOf(placement))
+
+	nodes, err := generateNodes(n)
+	if err != nil {
+		return nil, err
+	}
+	sortedNodes := SortNodes(nodes)
+	planned, info, err := planFiles(sortedNodes, initAllocBalance)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := diskFiles(target)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &GeneratePlan{
+		Dir:            target,
+		Exists:         len(existing) > 0,
+		Policy:         policyName(policy),
+		ChainID:        config.Conf.ChainID,
+		FaultTolerance: FaultTolerance(n),
+		QuorumSize:     QuorumSize(n),
+		Nodes:          make([]*PlanPlacement, 0, n),
+		Hosts:          make([]*PlanHost, 0),
+		Files:          make([]*PlanFile, 0),
+	}
+	if info != nil {
+		plan.GenesisHash = &info.Hash
+	}
+
+	hosts := make(map[string]*PlanHost)
+	for i, v := range sortedNodes {
+		node := &HostNode{Index: i, Host: placement[i].Host, Port: placement[i].Port, Node: v}
+		plan.Nodes = append(plan.Nodes, &PlanPlacement{PlanNode: planNodeOf(node), Host: node.Host, Port: node.Port})
+		h, ok := hosts[node.Host]
+		if !ok {
+			h = &PlanHost{Host: node.Host}
+			hosts[node.Host] = h
+			plan.Hosts = append(plan.Hosts, h)
+		}
+		h.Nodes = append(h.Nodes, i)
+		h.Ports = append(h.Ports, node.Port)
+	}
+
+	backup := policy == BackupExisting
+	for _, rel := range sortedPaths(planned) {
+		v := planned[rel]
+		f := &PlanFile{Path: rel, Action: PlanCreate, Secret: v.secret, Note: v.note}
+		if existing[rel] && !backup {
+			f.Action = PlanChange
+			if v.data != nil {
+				if disk, err := ioutil.ReadFile(path.Join(target, rel)); err == nil && bytes.Equal(disk, v.data) {
+					f.Action = PlanUnchanged
+				}
+			}
+		}
+		plan.Files = append(plan.Files, f)
+	}
+	removed := make([]string, 0)
+	for rel := range existing {
+		if _, ok := planned[rel]; !ok || backup {
+			removed = append(removed, rel)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return artifactLess(removed[i], removed[j]) })
+	for _, rel := range removed {
+		f := &PlanFile{Path: rel, Action: PlanRemove}
+		if backup {
+			f.Action, f.Note = PlanBackup, fmt.Sprintf("moved to %s.backup-<time>", target)
+		}
+		plan.Files = append(plan.Files, f)
+	}
+
+	plan.Warnings = append([]string{}, warnings...)
+	if err := checkNotRunning(target); err != nil {
+		plan.Warnings = append(plan.Warnings, err.Error()+", generate aborts")
+	}
+	if plan.Exists && policy == AbortIfExist {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("network in %s exists, generate aborts unless -force or -backup is given", target))
+	}
+	log.Infof("dry run of %d nodes in %s done, nothing written", n, target)
+	return plan, nil
+}
+
+func joinInts(list []int, prefix string) string {
+	s := make([]string, 0, len(list))
+	for _, v := range list {
+		s = append(s, fmt.Sprintf("%s%d", prefix, v))
+	}
+	return strings.Join(s, ",")
+}
+
+// PrintGeneratePlan prints the plan as tables of the nodes, hosts and files.
+func PrintGeneratePlan(w io.Writer, plan *GeneratePlan) {
+	fmt.Fprintf(w, "dry run of generate in %s, policy %s, nothing is written\n", plan.Dir, plan.Policy)
+	fmt.Fprintf(w, "%d validators tolerate %d faulty, quorum size %d, chain id %d\n",
+		len(plan.Nodes), plan.FaultTolerance, plan.QuorumSize, plan.ChainID)
+	if plan.GenesisHash != nil {
+		fmt.Fprintf(w, "genesis hash %s\n", plan.GenesisHash.Hex())
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tADDRESS\tHOST\tPORT")
+	for _, v := range plan.Nodes {
+		fmt.Fprintf(tw, "node%d\t%s\t%s\t%d\n", v.Index, v.Address.Hex(), v.Host, v.Port)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tNODES\tPORTS")
+	for _, h := range plan.Hosts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", h.Host, joinInts(h.Nodes, "node"), joinInts(h.Ports, ""))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	count := make(map[string]int)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tFILE\tNOTE")
+	for _, f := range plan.Files {
+		count[f.Action]++
+		note := f.Note
+		if f.Secret {
+			note = "secret"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Action, f.Path, note)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d to create, %d to change, %d to remove, %d to back up, %d unchanged\n",
+		count[PlanCreate], count[PlanChange], count[PlanRemove], count[PlanBackup], count[PlanUnchanged])
+
+	for _, v := range plan.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", v)
+	}
+}
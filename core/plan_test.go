@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+// hashFiles returns the sha256 of every network file under dir.
+func hashFiles(t *testing.T, dir string) map[string]string {
+	found, err := diskFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[string]string)
+	for rel := range found {
+		enc, err := ioutil.ReadFile(path.Join(dir, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[rel] = fmt.Sprintf("%x", sha256.Sum256(enc))
+	}
+	return hashes
+}
+
+func TestPlanGenerate(t *testing.T) {
+	dir := generateTestNetwork(t, 4)
+	before := hashFiles(t, dir)
+
+	plan, err := PlanGenerate("test", 3, "1000", ForceOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := hashFiles(t, dir)
+	if len(after) != len(before) {
+		t.Fatalf("dry run changed the files on disk, %d before and %d after", len(before), len(after))
+	}
+	for rel, hash := range before {
+		if after[rel] != hash {
+			t.Errorf("dry run changed %s", rel)
+		}
+	}
+	if len(before) == 0 || before["nodes/node0/nodekey"] == "" {
+		t.Fatalf("no node keys found in %s", dir)
+	}
+
+	actions := make(map[string]*PlanFile)
+	for _, f := range plan.Files {
+		actions[f.Path] = f
+	}
+	for p, expect := range map[string]string{
+		"nodes/node0/nodekey": PlanChange,
+		"nodes/node0/pubkey":  PlanChange,
+		"nodes/node3/nodekey": PlanRemove,
+		"nodes/node3/pubkey":  PlanRemove,
+		"genesis.json":        PlanChange,
+		"static-nodes.json":   PlanChange,
+		manifestFile:          PlanChange,
+	} {
+		if f, ok := actions[p]; !ok || f.Action != expect {
+			t.Errorf("%s: expect %s, got %+v", p, expect, f)
+		}
+	}
+	if !actions["nodes/node0/nodekey"].Secret {
+		t.Error("nodekey should be marked secret")
+	}
+	if len(plan.Nodes) != 3 || len(plan.Hosts) != 1 || len(plan.Hosts[0].Ports) != 3 || plan.QuorumSize != QuorumSize(3) {
+		t.Fatalf("unexpected placement %+v", plan)
+	}
+
+	buf := new(bytes.Buffer)
+	PrintGeneratePlan(buf, plan)
+	for _, expect := range []string{"policy overwrite", "127.0.0.1", "30302", "remove", "secret"} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expect %q in plan:\n%s", expect, buf.String())
+		}
+	}
+}
+
+func TestArtifactLess(t *testing.T) {
+	list := []string{manifestFile, "static-nodes.json", "genesis.json", "nodes/node1/pubkey", "nodes/node0/pubkey", genesisHashFile}
+	expect := []string{"nodes/node0/pubkey", "nodes/node1/pubkey", "genesis.json", genesisHashFile, "static-nodes.json", manifestFile}
+	m := make(map[string]*plannedFile)
+	for _, v := range list {
+		m[v] = &plannedFile{}
+	}
+	if got := strings.Join(sortedPaths(m), " "); got != strings.Join(expect, " ") {
+		t.Fatalf("expect %s, got %s", strings.Join(expect, " "), got)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// artifact covers the runtime bytecode fields of the common solidity build outputs:
+// hardhat `deployedBytecode` string, foundry `deployedBytecode.object`, solc standard json
+// `evm.deployedBytecode.object` and solc combined json `bin-runtime`.
+type artifact struct {
+	DeployedBytecode json.RawMessage `json:"deployedBytecode"`
+	BinRuntime       string          `json:"bin-runtime"`
+	Evm              *struct {
+		DeployedBytecode *struct {
+			Object string `json:"object"`
+		} `json:"deployedBytecode"`
+	} `json:"evm"`
+
+	// solc output, e.g. `{"contracts": {"contracts/Multicall.sol:Multicall": {...}}}`
+	Contracts map[string]json.RawMessage `json:"contracts"`
+}
+
+func (a *artifact) runtimeCode(name string) (string, error) {
+	if len(a.DeployedBytecode) > 0 {
+		var code string
+		if err := json.Unmarshal(a.DeployedBytecode, &code); err == nil {
+			return code, nil
+		}
+		obj := struct {
+			Object string `json:"object"`
+		}{}
+		if err := json.Unmarshal(a.DeployedBytecode, &obj); err != nil {
+			return "", fmt.Errorf("invalid deployedBytecode, err: %v", err)
+		}
+		return obj.Object, nil
+	}
+	if a.BinRuntime != "" {
+		return a.BinRuntime, nil
+	}
+	if a.Evm != nil && a.Evm.DeployedBytecode != nil {
+		return a.Evm.DeployedBytecode.Object, nil
+	}
+
+	for key, raw := range a.Contracts {
+		if key != name && !strings.HasSuffix(key, ":"+name) {
+			// solc standard json nests contracts by source file
+			nested := make(map[string]json.RawMessage)
+			if err := json.Unmarshal(raw, &nested); err != nil {
+				continue
+			}
+			if raw = nested[name]; raw == nil {
+				continue
+			}
+		}
+		sub := new(artifact)
+		if err := json.Unmarshal(raw, sub); err != nil {
+			return "", err
+		}
+		return sub.runtimeCode(name)
+	}
+	return "", fmt.Errorf("no runtime bytecode found for contract %s", name)
+}
+
+func predeployCode(v *config.Predeploy) ([]byte, error) {
+	code := v.Code
+	if v.Artifact != "" {
+		a := new(artifact)
+		if err := files.ReadJsonFile(v.Artifact, a); err != nil {
+			return nil, fmt.Errorf("read artifact %s failed, err: %v", v.Artifact, err)
+		}
+		var err error
+		if code, err = a.runtimeCode(v.Name); err != nil {
+			return nil, fmt.Errorf("artifact %s: %v", v.Artifact, err)
+		}
+	}
+
+	if strings.Contains(code, "__") {
+		return nil, fmt.Errorf("bytecode contains unlinked library placeholders")
+	}
+	if !strings.HasPrefix(code, "0x") {
+		code = "0x" + code
+	}
+	enc, err := hexutil.Decode(code)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bytecode, err: %v", err)
+	}
+	if len(enc) == 0 {
+		return nil, fmt.Errorf("empty runtime bytecode")
+	}
+	return enc, nil
+}
+
+// predeployAlloc returns the genesis alloc of the configured predeployed contracts, an address which
+// is taken by a validator or another contract is rejected.
+func predeployAlloc(sortedNodes []*Node) (map[string]*AllocInfo, error) {
+	taken := make(map[common.Address]string)
+	for i, v := range sortedNodes {
+		taken[v.Address] = fmt.Sprintf("validator node%d", i)
+	}
+
+	alloc := make(map[string]*AllocInfo)
+	for _, v := range config.Conf.Predeploys {
+		if !common.IsHexAddress(v.Address) {
+			return nil, fmt.Errorf("predeploy %s: invalid address %s", v.Name, v.Address)
+		}
+		addr := common.HexToAddress(v.Address)
+		if owner, ok := taken[addr]; ok {
+			return nil, fmt.Errorf("predeploy %s: address %s collides with %s", v.Name, addr.Hex(), owner)
+		}
+		taken[addr] = "predeploy " + v.Name
+
+		code, err := predeployCode(v)
+		if err != nil {
+			return nil, fmt.Errorf("predeploy %s: %v", v.Name, err)
+		}
+
+		storage := make(map[string]string)
+		for key, val := range v.Storage {
+			storage[common.HexToHash(key).Hex()] = common.HexToHash(val).Hex()
+		}
+
+		balance := v.Balance
+		if balance == "" {
+			balance = "0"
+		}
+		alloc[addr.Hex()] = &AllocInfo{
+			Balance: balance,
+			Code:    hexutil.Encode(code),
+			Storage: storage,
+		}
+		log.Infof("predeploy %s at %s, code size %d, storage slots %d", v.Name, addr.Hex(), len(code), len(storage))
+	}
+	return alloc, nil
+}
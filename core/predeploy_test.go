@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+const predeployRuntime = "6080604052348015600f57600080fd5b50"
+
+func TestPredeployCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zion-makeup-predeploy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name     string
+		artifact string
+		code     string
+		err      string
+	}{
+		{"hardhat", `{"contractName": "Multicall", "deployedBytecode": "0x` + predeployRuntime + `"}`, "", ""},
+		{"foundry", `{"deployedBytecode": {"object": "0x` + predeployRuntime + `", "sourceMap": ""}}`, "", ""},
+		{"solc", `{"contracts": {"contracts/Multicall.sol": {"Multicall": {"evm": {"deployedBytecode": {"object": "` + predeployRuntime + `"}}}}}}`, "", ""},
+		{"combined-json", `{"contracts": {"contracts/Multicall.sol:Multicall": {"bin-runtime": "` + predeployRuntime + `"}}}`, "", ""},
+		{"code", "", predeployRuntime, ""},
+		{"other contract", `{"contracts": {"contracts/Token.sol:Token": {"bin-runtime": "` + predeployRuntime + `"}}}`, "", "no runtime bytecode found"},
+		{"unlinked", `{"deployedBytecode": "0x6080__$3f2a1b$__6040"}`, "", "unlinked library placeholders"},
+		{"empty", `{"deployedBytecode": "0x"}`, "", "empty runtime bytecode"},
+		{"invalid hex", "", "0x60zz", "invalid bytecode"},
+		{"unreadable", "missing", "", "read artifact"},
+	}
+	for _, c := range cases {
+		v := &config.Predeploy{Name: "Multicall", Code: c.code}
+		if c.artifact == "missing" {
+			v.Artifact = path.Join(dir, "missing.json")
+		} else if c.artifact != "" {
+			v.Artifact = path.Join(dir, strings.Replace(c.name, " ", "-", -1)+".json")
+			if err := ioutil.WriteFile(v.Artifact, []byte(c.artifact), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		code, err := predeployCode(v)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expect err %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected err %v", c.name, err)
+		} else if got := hexutil.Encode(code); got != "0x"+predeployRuntime {
+			t.Errorf("%s: code %s, expect 0x%s", c.name, got, predeployRuntime)
+		}
+	}
+}
+
+func TestPredeployAlloc(t *testing.T) {
+	seedKeys(t, 1)
+	nodes, err := generateNodes(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.Conf
+	defer func() { config.Conf = conf }()
+
+	const addr = "0x0000000000000000000000000000000000001000"
+	config.Conf = &config.Config{Predeploys: []*config.Predeploy{{
+		Name:    "Multicall",
+		Code:    predeployRuntime,
+		Address: addr,
+		Storage: map[string]string{"0x0": "0x1"},
+	}}}
+	alloc, err := predeployAlloc(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, ok := alloc["0x0000000000000000000000000000000000001000"]
+	if !ok || v.Code != "0x"+predeployRuntime || v.Balance != "0" || len(v.Storage) != 1 {
+		t.Fatalf("unexpected alloc %+v", alloc)
+	}
+
+	for _, c := range []struct {
+		address string
+		err     string
+	}{
+		{nodes[1].Address.Hex(), "collides with validator node1"},
+		{addr, "collides with predeploy Multicall"},
+		{"0x1000", "invalid address"},
+	} {
+		other := &config.Predeploy{Name: "Other", Code: predeployRuntime, Address: c.address}
+		config.Conf.Predeploys = append(config.Conf.Predeploys[:1], other)
+		if _, err := predeployAlloc(nodes); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("address %s: expect err %q, got %v", c.address, c.err, err)
+		}
+	}
+}
+
+func TestRunPredeployError(t *testing.T) {
+	generateTestNetwork(t, 4)
+	config.Conf.Predeploys = []*config.Predeploy{{Name: "Multicall", Artifact: "missing.json", Address: "0x0000000000000000000000000000000000001000"}}
+	err := Run("other", 4, config.Conf.InitBalance, AbortIfExist)
+	if err == nil || !strings.Contains(err.Error(), "predeploy Multicall: read artifact") {
+		t.Fatalf("expect the predeploy error returned, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(folder, "other")); !os.IsNotExist(err) {
+		t.Fatalf("failed run left the network, err %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// warnings collects the warnings logged by the command for the run report, it is reset when a
+// command starts so that warnings of an earlier command in the process are not reported.
+var warnings = make([]string, 0)
+
+func resetWarnings() {
+	warnings = make([]string, 0)
+}
+
+func warnf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	warnings = append(warnings, msg)
+	log.Warn(msg)
+}
+
+// ReportNode denotes a node of the network in the run report, NodeKey is the path of its key.
+type ReportNode struct {
+	*PlanNode
+	NodeKey string `json:"nodekey"`
+}
+
+// Report describes the network of an environment for scripts, it is printed as json by
+// `-report=json` after the command.
+type Report struct {
+	Dir              string        `json:"dir"`
+	ChainID          uint64        `json:"chainId"`
+	GenesisHash      common.Hash   `json:"genesisHash"`
+	GenesisStateRoot common.Hash   `json:"genesisStateRoot"`
+	Nodes            []*ReportNode `json:"nodes"`
+	Files            []string      `json:"files"`
+	Warnings         []string      `json:"warnings"`
+}
+
+// NetworkReport describes the network in `build/<dir>` together with the warnings of the command.
+func NetworkReport(dir string) (*Report, error) {
+	env = path.Join(folder, dir)
+	manifest := new(Manifest)
+	if err := files.ReadJsonFile(path.Join(env, manifestFile), manifest); err != nil {
+		return nil, fmt.Errorf("read manifest failed, err: %v", err)
+	}
+	list, err := loadNetwork(env)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Dir:              env,
+		ChainID:          manifest.ChainID,
+		GenesisHash:      manifest.GenesisHash,
+		GenesisStateRoot: manifest.GenesisStateRoot,
+		Nodes:            make([]*ReportNode, 0, len(list)),
+		Files:            make([]string, 0),
+		Warnings:         append([]string{}, warnings...),
+	}
+	for _, v := range list {
+		report.Nodes = append(report.Nodes, &ReportNode{
+			PlanNode: planNodeOf(v),
+			NodeKey:  path.Join(env, "nodes", fmt.Sprintf("node%d", v.Index), "nodekey"),
+		})
+	}
+
+	for _, name := range existingArtifacts(env) {
+		err := filepath.Walk(path.Join(env, name), func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				report.Files = append(report.Files, filepath.ToSlash(p))
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
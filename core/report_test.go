@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestNetworkReport(t *testing.T) {
+	warnf("warning of an earlier command")
+	dir := generateTestNetwork(t, 4)
+	report, err := NetworkReport("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.ChainID != 60801 || report.GenesisHash == (common.Hash{}) {
+		t.Fatalf("unexpected chain id %d and genesis hash %s", report.ChainID, report.GenesisHash.Hex())
+	}
+	staticNodes := make([]string, 0)
+	if err := files.ReadJsonFile(path.Join(dir, "static-nodes.json"), &staticNodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Nodes) != len(staticNodes) {
+		t.Fatalf("expect %d nodes, got %d", len(staticNodes), len(report.Nodes))
+	}
+	for i, v := range report.Nodes {
+		if v.Index != i || v.Enode != staticNodes[i] {
+			t.Errorf("node %d: index %d, enode %s, expect %s", i, v.Index, v.Enode, staticNodes[i])
+		}
+		if _, err := os.Stat(v.NodeKey); err != nil {
+			t.Errorf("node %d: %v", i, err)
+		}
+	}
+
+	listed := strings.Join(report.Files, "\n")
+	for _, name := range []string{"genesis.json", "static-nodes.json", manifestFile, "nodes/node0/pubkey"} {
+		if !strings.Contains(listed, path.Join(report.Dir, name)) {
+			t.Errorf("%s is not listed in files", name)
+		}
+	}
+	warned := strings.Join(report.Warnings, "\n")
+	if !strings.Contains(warned, "single host") || strings.Contains(warned, "earlier command") {
+		t.Errorf("expect only the single host warning of generate, got %v", report.Warnings)
+	}
+}
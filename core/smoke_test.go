@@ -0,0 +1,219 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/eth"
+	"github.com/ethereum/go-ethereum/eth/downloader"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+const (
+	smokeNodes   = 4
+	smokeHeight  = 5
+	smokeTimeout = 2 * time.Minute
+)
+
+// generateTestNetwork runs `generate` for n nodes on the loopback host in a temporary working
+// directory, and returns the directory of the network.
+func generateTestNetwork(t *testing.T, n int) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "zion-makeup-network-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	conf := config.Conf
+	t.Cleanup(func() {
+		config.Conf = conf
+		os.Chdir(wd)
+		os.RemoveAll(tmp)
+	})
+
+	config.Conf = &config.Config{
+		IpList:      []string{localHost},
+		StartPort:   30300,
+		InitBalance: "100000000000000000000000000000",
+		ChainID:     60801,
+		Nodes:       n,
+	}
+	if err := Run("test", n, config.Conf.InitBalance, AbortIfExist); err != nil {
+		t.Fatal(err)
+	}
+	return path.Join(tmp, folder, "test")
+}
+
+// startSmokeNode runs a mining node in memory with the nodekey, listening on a random loopback port.
+func startSmokeNode(t *testing.T, genesis *core.Genesis, v *HostNode) (*node.Node, *eth.Ethereum) {
+	stack, err := node.New(&node.Config{
+		Name: "zion",
+		P2P: p2p.Config{
+			PrivateKey:  v.Node.NodeKey,
+			ListenAddr:  localHost + ":0",
+			NoDiscovery: true,
+			MaxPeers:    smokeNodes,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stack.Close() })
+
+	conf := ethconfig.Defaults
+	conf.Genesis = genesis
+	conf.NetworkId = genesis.Config.ChainID.Uint64()
+	conf.SyncMode = downloader.FullSync
+	conf.Miner.Etherbase = v.Node.Address
+	conf.Miner.GasCeil = genesis.GasLimit
+	conf.Miner.GasPrice = big.NewInt(1)
+	conf.Miner.Recommit = time.Second
+	backend, err := eth.New(stack, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stack.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.StartMining(1); err != nil {
+		t.Fatal(err)
+	}
+	return stack, backend
+}
+
+// TestSmokeHotstuff runs the generated genesis and nodekeys in memory, and checks that blocks are
+// sealed by the validator set encoded in the genesis extra.
+func TestSmokeHotstuff(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip the in-process network in short mode")
+	}
+
+	dir := generateTestNetwork(t, smokeNodes)
+	list, err := loadNetwork(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := new(core.Genesis)
+	if err := files.ReadJsonFile(path.Join(dir, "genesis.json"), genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	// the genesis extra is the encoding of the validators in node order
+	validators := validatorsOf(list)
+	extra, err := Encode(validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc := hexutil.Encode(genesis.ExtraData); enc != extra {
+		t.Fatalf("genesis extra %s is not the encoding of the validators %s", enc, extra)
+	}
+	expect := make(map[common.Address]bool)
+	for _, v := range validators {
+		expect[v] = true
+	}
+
+	stacks := make([]*node.Node, 0, len(list))
+	backends := make([]*eth.Ethereum, 0, len(list))
+	for _, v := range list {
+		stack, backend := startSmokeNode(t, genesis, v)
+		stacks = append(stacks, stack)
+		backends = append(backends, backend)
+	}
+	for i := range stacks {
+		for j := i + 1; j < len(stacks); j++ {
+			stacks[i].Server().AddPeer(stacks[j].Server().Self())
+		}
+	}
+
+	for deadline := time.Now().Add(smokeTimeout); ; time.Sleep(500 * time.Millisecond) {
+		ready := true
+		for _, b := range backends {
+			if b.BlockChain().CurrentBlock().NumberU64() < smokeHeight {
+				ready = false
+			}
+		}
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			for i, b := range backends {
+				t.Logf("node%d at height %d", i, b.BlockChain().CurrentBlock().NumberU64())
+			}
+			t.Fatalf("nodes not at height %d in %s", smokeHeight, smokeTimeout)
+		}
+	}
+
+	chain := backends[0].BlockChain()
+	for number := uint64(1); number <= smokeHeight; number++ {
+		header := chain.GetHeaderByNumber(number)
+		author, err := backends[0].Engine().Author(header)
+		if err != nil {
+			t.Fatalf("block %d: recover author failed, err: %v", number, err)
+		}
+		if !expect[author] {
+			t.Errorf("block %d sealed by %s out of the validator set", number, author.Hex())
+		}
+		for i, b := range backends[1:] {
+			if other := b.BlockChain().GetHeaderByNumber(number); other == nil || other.Hash() != header.Hash() {
+				t.Errorf("block %d of node%d differs from node0", number, i+1)
+			}
+		}
+	}
+
+	// the validators are kept in the extra of sealed blocks as they are in genesis
+	head := chain.CurrentBlock().Header()
+	payload, err := types.ExtractHotstuffExtraPayload(head.Extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameAddresses(payload.Validators, validators) {
+		t.Errorf("validators %v in block %d, expect %v", payload.Validators, head.Number, validators)
+	}
+}
+
+func sameAddresses(a, b []common.Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// rpcTimeout bounds a single round of queries to a node, so that a hung node can not block
+// `status` or a poll of `wait`.
+const rpcTimeout = 5 * time.Second
+
+// StatusOptions denotes how the rpc endpoints of nodes are found. Endpoints overrides the endpoint
+// of each node in index order, otherwise the endpoints of a network launched by `up` are used, and
+// `http://<host>:<RPCPort + index>` for the others.
+type StatusOptions struct {
+	RPCPort   int
+	Endpoints []string
+	Interval  time.Duration
+}
+
+// NodeStatus denotes the health of a node reported by its json rpc. Validators is the size of the
+// hotstuff validator set seen by the node, and -1 if the node does not report it.
+type NodeStatus struct {
+	Index      int
+	Address    common.Address
+	RPC        string
+	Height     uint64
+	Peers      int
+	Validators int
+	Validator  bool
+	Err        error
+}
+
+type statusTarget struct {
+	Index   int
+	Address common.Address
+	URL     string
+	Client  *rpc.Client
+}
+
+func newStatusTarget(index int, addr common.Address, url string) (*statusTarget, error) {
+	client, err := rpc.DialHTTP(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpc endpoint %s of node%d, err: %v", url, index, err)
+	}
+	return &statusTarget{Index: index, Address: addr, URL: url, Client: client}, nil
+}
+
+// statusTargets returns the rpc clients of all nodes in the network of dir.
+func statusTargets(dir string, opts *StatusOptions) ([]*statusTarget, error) {
+	list, err := loadNetwork(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Endpoints) > 0 && len(opts.Endpoints) != len(list) {
+		return nil, fmt.Errorf("%d endpoints given for %d nodes", len(opts.Endpoints), len(list))
+	}
+
+	launched := make(map[int]string)
+	if launch, err := loadLaunch(dir); err == nil {
+		for _, v := range launch.Nodes {
+			launched[v.Index] = v.RPC
+		}
+	}
+
+	targets := make([]*statusTarget, 0, len(list))
+	for i, v := range list {
+		url, ok := launched[v.Index]
+		switch {
+		case len(opts.Endpoints) > 0:
+			url = opts.Endpoints[i]
+		case !ok:
+			url = fmt.Sprintf("http://%s:%d", v.Host, opts.RPCPort+v.Index)
+		}
+		t, err := newStatusTarget(v.Index, v.Node.Address, url)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func queryNode(ctx context.Context, t *statusTarget) *NodeStatus {
+	s := &NodeStatus{Index: t.Index, Address: t.Address, RPC: t.URL, Validators: -1}
+
+	height, err := ethclient.NewClient(t.Client).BlockNumber(ctx)
+	if err != nil {
+		s.Err = err
+		return s
+	}
+	var peers hexutil.Uint64
+	if err := t.Client.CallContext(ctx, &peers, "net_peerCount"); err != nil {
+		s.Err = err
+		return s
+	}
+	s.Height, s.Peers = height, int(peers)
+
+	// the validator set is informative, nodes without the hotstuff api are still healthy
+	validators := make([]common.Address, 0)
+	if err := t.Client.CallContext(ctx, &validators, "hotstuff_getValidators", "latest"); err != nil {
+		log.Debugf("node%d: query validators failed, err: %v", t.Index, err)
+		return s
+	}
+	s.Validators = len(validators)
+	for _, v := range validators {
+		if v == t.Address {
+			s.Validator = true
+		}
+	}
+	return s
+}
+
+// queryStatus queries all nodes concurrently, each of them in rpcTimeout, the result is in the
+// order of targets.
+func queryStatus(ctx context.Context, targets []*statusTarget) []*NodeStatus {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+
+	list := make([]*NodeStatus, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *statusTarget) {
+			defer wg.Done()
+			list[i] = queryNode(ctx, t)
+		}(i, t)
+	}
+	wg.Wait()
+	return list
+}
+
+func printStatus(w io.Writer, list []*NodeStatus) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tADDRESS\tRPC\tHEIGHT\tPEERS\tVALIDATORS\tERROR")
+	for _, s := range list {
+		if s.Err != nil {
+			fmt.Fprintf(tw, "node%d\t%s\t%s\t-\t-\t-\t%v\n", s.Index, s.Address.Hex(), s.RPC, s.Err)
+			continue
+		}
+		validators := "-"
+		if s.Validators >= 0 {
+			validators = fmt.Sprintf("%d", s.Validators)
+			if !s.Validator {
+				validators += " (not in set)"
+			}
+		}
+		fmt.Fprintf(tw, "node%d\t%s\t%s\t%d\t%d\t%s\t\n", s.Index, s.Address.Hex(), s.RPC, s.Height, s.Peers, validators)
+	}
+	tw.Flush()
+}
+
+// notReady returns the reason why the node is not ready, or an empty string if it is at least at
+// height with the full peer count.
+func notReady(s *NodeStatus, height uint64, peers int) string {
+	switch {
+	case s.Err != nil:
+		return fmt.Sprintf("node%d: %v", s.Index, s.Err)
+	case s.Height < height:
+		return fmt.Sprintf("node%d: height %d < %d", s.Index, s.Height, height)
+	case s.Peers < peers:
+		return fmt.Sprintf("node%d: peers %d < %d", s.Index, s.Peers, peers)
+	}
+	return ""
+}
+
+// Status prints the health of every node in the network of the environment, and returns an error
+// if any node is unreachable.
+func Status(dir string, opts *StatusOptions) error {
+	env = path.Join(folder, dir)
+	targets, err := statusTargets(env, opts)
+	if err != nil {
+		return err
+	}
+	return reportStatus(os.Stdout, targets)
+}
+
+func reportStatus(w io.Writer, targets []*statusTarget) error {
+	list := queryStatus(context.Background(), targets)
+	printStatus(w, list)
+
+	down := 0
+	for _, s := range list {
+		if s.Err != nil {
+			down++
+		}
+	}
+	if down > 0 {
+		return fmt.Errorf("%d of %d nodes are unreachable", down, len(list))
+	}
+	return nil
+}
+
+// Wait blocks until every node of the environment is at least at height with all other nodes as
+// peers, or the timeout passes.
+func Wait(dir string, opts *StatusOptions, height uint64, timeout time.Duration) error {
+	env = path.Join(folder, dir)
+	targets, err := statusTargets(env, opts)
+	if err != nil {
+		return err
+	}
+	return waitReady(os.Stdout, targets, height, timeout, opts.Interval)
+}
+
+// waitReady polls the nodes until they are ready or the timeout passes. each poll is bounded by
+// rpcTimeout alone, so that the last poll reports why the nodes are not ready rather than the
+// expired deadline.
+func waitReady(w io.Writer, targets []*statusTarget, height uint64, timeout, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	peers := len(targets) - 1
+	log.Infof("wait for %d nodes at height %d with %d peers, timeout %s", len(targets), height, peers, timeout)
+	for {
+		list := queryStatus(context.Background(), targets)
+		reasons := make([]string, 0)
+		for _, s := range list {
+			if reason := notReady(s, height, peers); reason != "" {
+				reasons = append(reasons, reason)
+			}
+		}
+		if len(reasons) == 0 {
+			printStatus(w, list)
+			log.Infof("all nodes are ready")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			printStatus(w, list)
+			return fmt.Errorf("nodes are not ready in %s:\n\t%s", timeout, strings.Join(reasons, "\n\t"))
+		case <-time.After(interval):
+			log.Debugf("%d nodes are not ready, %s", len(reasons), reasons[0])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// fakeNode serves the json rpc methods queried by status, its height grows by one on every query.
+type fakeNode struct {
+	height     uint64
+	peers      int64
+	validators []common.Address
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     uint64 `json:"id"`
+		Method string `json:"method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	switch req.Method {
+	case "eth_blockNumber":
+		res["result"] = fmt.Sprintf("0x%x", atomic.AddUint64(&n.height, 1))
+	case "net_peerCount":
+		res["result"] = fmt.Sprintf("0x%x", atomic.LoadInt64(&n.peers))
+	case "hotstuff_getValidators":
+		if n.validators == nil {
+			res["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+		} else {
+			res["result"] = n.validators
+		}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func fakeNetwork(t *testing.T, nodes []*fakeNode) []*statusTarget {
+	targets := make([]*statusTarget, 0, len(nodes))
+	for i, n := range nodes {
+		srv := httptest.NewServer(n)
+		t.Cleanup(srv.Close)
+		addr := common.BytesToAddress([]byte{byte(i + 1)})
+		target, err := newStatusTarget(i, addr, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+func TestStatus(t *testing.T) {
+	validators := []common.Address{common.BytesToAddress([]byte{1}), common.BytesToAddress([]byte{2})}
+	targets := fakeNetwork(t, []*fakeNode{
+		{height: 9, peers: 2, validators: validators},
+		{height: 9, peers: 2, validators: validators},
+		{height: 9, peers: 2},
+	})
+	// an unreachable node
+	down, err := newStatusTarget(3, common.Address{}, "http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets = append(targets, down)
+
+	buf := new(bytes.Buffer)
+	err = reportStatus(buf, targets)
+	if err == nil || !strings.Contains(err.Error(), "1 of 4 nodes are unreachable") {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expect 5 lines, got:\n%s", buf.String())
+	}
+	for i, expect := range []string{"10 2 2", "10 2 2", "10 2 -", "- - -"} {
+		fields := strings.Fields(lines[i+1])
+		if got := strings.Join(fields[3:6], " "); got != expect {
+			t.Errorf("line %d: expect %q, got %q", i+1, expect, got)
+		}
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	nodes := []*fakeNode{{peers: 2}, {peers: 2}, {peers: 2}}
+	targets := fakeNetwork(t, nodes)
+
+	if err := waitReady(new(bytes.Buffer), targets, 5, 5*time.Second, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// a node which misses a peer never gets ready
+	atomic.StoreInt64(&nodes[2].peers, 1)
+	err := waitReady(new(bytes.Buffer), targets, 5, 100*time.Millisecond, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "node2: peers 1 < 2") {
+		t.Fatalf("unexpected err %v", err)
+	}
+}
@@ -0,0 +1,502 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	changesFolder = "changes"
+	archiveFolder = "archive"
+)
+
+type PlanNode struct {
+	Index   int            `json:"index"`
+	Address common.Address `json:"address"`
+	PubKey  string         `json:"pubkey"`
+	Enode   string         `json:"enode"`
+}
+
+// ChangePlan describes a validator set change of a running network. the genesis is left as it is,
+// validators in Propose should be added and those in Remove removed through the governance or
+// voting mechanism of the chain. Extra is the genesis extra of the new validator set, for a chain
+// which is started again from a new genesis.
+type ChangePlan struct {
+	Action       string           `json:"action"`
+	Before       []common.Address `json:"validatorsBefore"`
+	After        []common.Address `json:"validatorsAfter"`
+	Propose      []common.Address `json:"propose,omitempty"`
+	Remove       []common.Address `json:"remove,omitempty"`
+	NewNodes     []*PlanNode      `json:"newNodes,omitempty"`
+	QuorumBefore int              `json:"quorumBefore"`
+	QuorumAfter  int              `json:"quorumAfter"`
+	StaticNodes  []string         `json:"staticNodes"`
+	Extra        string           `json:"extra"`
+}
+
+// loadNetwork reads the node keys in `nodes/node<N>` of the network directory together with the
+// endpoints recorded in `static-nodes.json`, and returns them in order of node index.
+func loadNetwork(dir string) ([]*HostNode, error) {
+	staticNodes := make([]string, 0)
+	if err := files.ReadJsonFile(path.Join(dir, "static-nodes.json"), &staticNodes); err != nil {
+		return nil, fmt.Errorf("read static nodes failed, err: %v", err)
+	}
+	endpoints := make(map[string]*url.URL)
+	for _, v := range staticNodes {
+		u, err := url.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid enode %s, err: %v", v, err)
+		}
+		endpoints[u.User.Username()] = u
+	}
+
+	entries, err := ioutil.ReadDir(path.Join(dir, "nodes"))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*HostNode, 0)
+	for _, entry := range entries {
+		var index int
+		if _, err := fmt.Sscanf(entry.Name(), "node%d", &index); err != nil || !entry.IsDir() {
+			continue
+		}
+		key, err := crypto.LoadECDSA(path.Join(dir, "nodes", entry.Name(), "nodekey"))
+		if err != nil {
+			return nil, fmt.Errorf("load nodekey of %s failed, err: %v", entry.Name(), err)
+		}
+		node := &Node{Address: crypto.PubkeyToAddress(key.PublicKey), NodeKey: key}
+
+		u, ok := endpoints[node.ID()]
+		if !ok {
+			return nil, fmt.Errorf("%s is not found in static nodes", entry.Name())
+		}
+		port, err := strconv.Atoi(u.Port())
+		if err != nil {
+			return nil, fmt.Errorf("invalid enode port of %s, err: %v", entry.Name(), err)
+		}
+		list = append(list, &HostNode{Index: index, Host: u.Hostname(), Port: port, Node: node})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+	return list, nil
+}
+
+func staticNodesOf(list []*HostNode) []string {
+	staticNodes := make([]string, 0, len(list))
+	for _, v := range list {
+		staticNodes = append(staticNodes, NodeStaticInfoTemp(v.Node.ID(), v.Host, v.Port))
+	}
+	return staticNodes
+}
+
+// validatorsOf returns the validator addresses in the order of `SortNodes`.
+func validatorsOf(list []*HostNode) []common.Address {
+	nodes := make([]*Node, 0, len(list))
+	for _, v := range list {
+		nodes = append(nodes, v.Node)
+	}
+	addrs := make([]common.Address, 0, len(list))
+	for _, v := range SortNodes(nodes) {
+		addrs = append(addrs, v.Address)
+	}
+	return addrs
+}
+
+// assignEndpoint places a new node on the host picked by `pickHost` with the existing nodes, the
+// port follows the max one used on that host.
+func assignEndpoint(list []*HostNode) (string, int) {
+	count := make(map[string]int)
+	ports := make(map[string]int)
+	for _, v := range list {
+		for _, d := range failureDomains(v.Host) {
+			count[d]++
+		}
+		if v.Port > ports[v.Host] {
+			ports[v.Host] = v.Port
+		}
+	}
+
+	host := pickHost(count)
+	if port, ok := ports[host]; ok {
+		return host, port + 1
+	}
+	return host, config.Conf.StartPort
+}
+
+// refreshNetwork rewrite the files derived from the node list, which are the static nodes, the
+// bundles if they were generated before, and the manifest which should be the last one.
+func refreshNetwork(dir string, list []*HostNode) error {
+	enc, err := json.MarshalIndent(staticNodesOf(list), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := files.WriteFileAtomic(path.Join(dir, "static-nodes.json"), enc, files.PublicFileMode); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path.Join(dir, bundleFolder)); err == nil {
+		if err := os.RemoveAll(path.Join(dir, bundleFolder)); err != nil {
+			return err
+		}
+		if err := writeBundles(dir, list); err != nil {
+			return err
+		}
+	}
+
+	info, err := manifestGenesisInfo(dir)
+	if err != nil {
+		return err
+	}
+	return saveManifest(dir, info)
+}
+
+// manifestGenesisInfo returns the genesis identity recorded in the manifest of the network, the genesis
+// is never changed after generate so it is not computed again.
+func manifestGenesisInfo(dir string) (*GenesisInfo, error) {
+	manifest := new(Manifest)
+	if err := files.ReadJsonFile(path.Join(dir, manifestFile), manifest); err != nil {
+		return nil, fmt.Errorf("read manifest failed, err: %v", err)
+	}
+	if raw, err := ioutil.ReadFile(path.Join(dir, genesisHashFile)); err == nil {
+		if hash := common.HexToHash(strings.TrimSpace(string(raw))); hash != manifest.GenesisHash {
+			return nil, fmt.Errorf("genesis hash %s in %s differs from %s in manifest", hash.Hex(), genesisHashFile, manifest.GenesisHash.Hex())
+		}
+	}
+	return &GenesisInfo{Hash: manifest.GenesisHash, StateRoot: manifest.GenesisStateRoot}, nil
+}
+
+func planNodeOf(v *HostNode) *PlanNode {
+	return &PlanNode{
+		Index:   v.Index,
+		Address: v.Node.Address,
+		PubKey:  v.Node.PubKeyHex(),
+		Enode:   NodeStaticInfoTemp(v.Node.ID(), v.Host, v.Port),
+	}
+}
+
+// savePlan write the plan and the static nodes which should be distributed to every node into
+// `changes/<timestamp>-<action>`, and returns the path of the plan directory relative to dir.
+func savePlan(dir string, plan *ChangePlan) (string, error) {
+	if err := os.MkdirAll(path.Join(dir, changesFolder), files.PublicDirMode); err != nil {
+		return "", err
+	}
+	planDir := uniqueDir(path.Join(dir, changesFolder, fmt.Sprintf("%s-%s", time.Now().Format("20060102-150405"), plan.Action)))
+	if err := os.Mkdir(planDir, files.PublicDirMode); err != nil {
+		return "", err
+	}
+	enc, err := json.MarshalIndent(plan, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	if err := files.WriteFileAtomic(path.Join(planDir, "plan.json"), enc, files.PublicFileMode); err != nil {
+		return "", err
+	}
+	if enc, err = json.MarshalIndent(plan.StaticNodes, "", "\t"); err != nil {
+		return "", err
+	}
+	if err := files.WriteFileAtomic(path.Join(planDir, "static-nodes.json"), enc, files.PublicFileMode); err != nil {
+		return "", err
+	}
+
+	for i, v := range plan.After {
+		log.Infof("validator %d: %s", i, v.Hex())
+	}
+	for _, v := range plan.Propose {
+		log.Infof("propose to add validator %s", v.Hex())
+	}
+	for _, v := range plan.Remove {
+		log.Infof("propose to remove validator %s", v.Hex())
+	}
+	log.Infof("validators %d -> %d, fault tolerance %d -> %d, quorum %d -> %d",
+		len(plan.Before), len(plan.After), FaultTolerance(len(plan.Before)), FaultTolerance(len(plan.After)),
+		plan.QuorumBefore, plan.QuorumAfter)
+	return filepath.Rel(dir, planDir)
+}
+
+// changeNetwork applies a validator change to a staged copy of the network in dir, the change returns
+// the plan and the new node list, from which the plan and derived files are written. the network is
+// moved into place only if all of them are written, so a failed change leaves dir untouched.
+func changeNetwork(dir string, change func() (*ChangePlan, []*HostNode, error)) error {
+	resetWarnings()
+	target := path.Join(folder, dir)
+	if err := checkNotRunning(target); err != nil {
+		return err
+	}
+	staging, err := stageNetwork(target)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	env = staging
+
+	plan, list, err := change()
+	if err != nil {
+		return err
+	}
+	if plan.Extra, err = Encode(plan.After); err != nil {
+		return err
+	}
+	checkFailureDomains(list)
+	planDir, err := savePlan(env, plan)
+	if err != nil {
+		return err
+	}
+	if err := refreshNetwork(env, list); err != nil {
+		return err
+	}
+
+	env = target
+	if err := commitChange(staging, target); err != nil {
+		return err
+	}
+	log.Infof("%s plan saved to %s", plan.Action, path.Join(target, planDir))
+	return applyOwnership(target)
+}
+
+// AddValidators generate n new node keys for an existing network and emit the change plan, the
+// keys of existing nodes are left untouched and new nodes are numbered after them.
+func AddValidators(dir string, n int) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid number of new validators %d", n)
+	}
+	return changeNetwork(dir, func() (*ChangePlan, []*HostNode, error) {
+		list, err := loadNetwork(env)
+		if err != nil {
+			return nil, nil, err
+		}
+		before := validatorsOf(list)
+
+		next := 0
+		if len(list) > 0 {
+			next = list[len(list)-1].Index + 1
+		}
+		newNodes := make([]*PlanNode, 0, n)
+		propose := make([]common.Address, 0, n)
+		nodes, err := generateNodes(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, node := range nodes {
+			index := next + i
+			if _, err := os.Stat(path.Join(env, "nodes", fmt.Sprintf("node%d", index))); err == nil {
+				return nil, nil, fmt.Errorf("node%d already exists", index)
+			}
+			if err := saveNode(index, node); err != nil {
+				return nil, nil, err
+			}
+
+			host, port := assignEndpoint(list)
+			v := &HostNode{Index: index, Host: host, Port: port, Node: node}
+			list = append(list, v)
+			newNodes = append(newNodes, planNodeOf(v))
+			propose = append(propose, node.Address)
+		}
+		after := validatorsOf(list)
+
+		return &ChangePlan{
+			Action:       "add",
+			Before:       before,
+			After:        after,
+			Propose:      propose,
+			NewNodes:     newNodes,
+			QuorumBefore: QuorumSize(len(before)),
+			QuorumAfter:  QuorumSize(len(after)),
+			StaticNodes:  staticNodesOf(list),
+		}, list, nil
+	})
+}
+
+// archiveNode move the key material of a node into the archive directory of the change.
+func archiveNode(dir, archive string, index int) error {
+	if err := os.MkdirAll(archive, files.SecretDirMode); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("node%d", index)
+	return os.Rename(path.Join(dir, "nodes", name), path.Join(archive, name))
+}
+
+func archiveDir(dir, action string) string {
+	return uniqueDir(path.Join(dir, archiveFolder, fmt.Sprintf("%s-%s", time.Now().Format("20060102-150405"), action)))
+}
+
+// RemoveValidators removes the nodes selected by index or address from an existing network and emit
+// the change plan. key material of removed nodes is archived, and the remaining node directories
+// are renumbered from 0 if renumber is set, otherwise they keep their index. the remaining nodes are
+// checked as `generate` checks a new network, and a failed check only warns if unsafe is set.
+func RemoveValidators(dir string, indices []int, addresses []string, renumber, unsafe bool) error {
+	return changeNetwork(dir, func() (*ChangePlan, []*HostNode, error) {
+		list, err := loadNetwork(env)
+		if err != nil {
+			return nil, nil, err
+		}
+		before := validatorsOf(list)
+
+		selected := make(map[int]bool)
+		for _, index := range indices {
+			found := false
+			for _, v := range list {
+				if v.Index == index {
+					selected[index], found = true, true
+				}
+			}
+			if !found {
+				return nil, nil, fmt.Errorf("node%d not found", index)
+			}
+		}
+		for _, addr := range addresses {
+			if !common.IsHexAddress(addr) {
+				return nil, nil, fmt.Errorf("invalid address %s", addr)
+			}
+			found := false
+			for _, v := range list {
+				if v.Node.Address == common.HexToAddress(addr) {
+					selected[v.Index], found = true, true
+				}
+			}
+			if !found {
+				return nil, nil, fmt.Errorf("validator %s not found", addr)
+			}
+		}
+		if len(selected) == 0 {
+			return nil, nil, fmt.Errorf("no validator selected")
+		}
+		if len(selected) == len(list) {
+			return nil, nil, fmt.Errorf("can not remove all validators")
+		}
+
+		remaining := make([]*HostNode, 0, len(list))
+		for _, v := range list {
+			if !selected[v.Index] {
+				remaining = append(remaining, v)
+			}
+		}
+		if err := CheckFaultTolerance(len(remaining), endpointsOf(remaining)); err != nil {
+			if !unsafe {
+				return nil, nil, fmt.Errorf("%v, use -unsafe to remove anyway", err)
+			}
+			warnf("%v, removed anyway", err)
+		}
+
+		archive := archiveDir(env, "remove")
+		remove := make([]common.Address, 0, len(selected))
+		for _, v := range list {
+			if !selected[v.Index] {
+				continue
+			}
+			if err := archiveNode(env, archive, v.Index); err != nil {
+				return nil, nil, fmt.Errorf("archive node%d failed, err: %v", v.Index, err)
+			}
+			remove = append(remove, v.Node.Address)
+			log.Infof("node%d %s archived to %s", v.Index, v.Node.Address.Hex(), path.Join(folder, dir, archiveFolder, path.Base(archive)))
+		}
+
+		if renumber {
+			for i, v := range remaining {
+				if v.Index == i {
+					continue
+				}
+				src := path.Join(env, "nodes", fmt.Sprintf("node%d", v.Index))
+				dst := path.Join(env, "nodes", fmt.Sprintf("node%d", i))
+				if err := os.Rename(src, dst); err != nil {
+					return nil, nil, fmt.Errorf("renumber node%d failed, err: %v", v.Index, err)
+				}
+				log.Infof("node%d renumbered to node%d", v.Index, i)
+				v.Index = i
+			}
+		}
+		after := validatorsOf(remaining)
+
+		return &ChangePlan{
+			Action:       "remove",
+			Before:       before,
+			After:        after,
+			Remove:       remove,
+			QuorumBefore: QuorumSize(len(before)),
+			QuorumAfter:  QuorumSize(len(after)),
+			StaticNodes:  staticNodesOf(remaining),
+		}, remaining, nil
+	})
+}
+
+// RotateKey replaces the key of a node with a new one, the node keeps its index and endpoint and
+// the old key material is archived.
+func RotateKey(dir string, index int) error {
+	return changeNetwork(dir, func() (*ChangePlan, []*HostNode, error) {
+		list, err := loadNetwork(env)
+		if err != nil {
+			return nil, nil, err
+		}
+		before := validatorsOf(list)
+
+		var target *HostNode
+		for _, v := range list {
+			if v.Index == index {
+				target = v
+			}
+		}
+		if target == nil {
+			return nil, nil, fmt.Errorf("node%d not found", index)
+		}
+		old := target.Node.Address
+
+		archive := archiveDir(env, "rotate")
+		if err := archiveNode(env, archive, index); err != nil {
+			return nil, nil, fmt.Errorf("archive node%d failed, err: %v", index, err)
+		}
+		nodes, err := generateNodes(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		target.Node = nodes[0]
+		if err := saveNode(index, target.Node); err != nil {
+			return nil, nil, err
+		}
+		log.Infof("node%d rotated from %s to %s, old key archived to %s", index, old.Hex(), target.Node.Address.Hex(),
+			path.Join(folder, dir, archiveFolder, path.Base(archive)))
+		after := validatorsOf(list)
+
+		return &ChangePlan{
+			Action:       "rotate",
+			Before:       before,
+			After:        after,
+			Propose:      []common.Address{target.Node.Address},
+			Remove:       []common.Address{old},
+			NewNodes:     []*PlanNode{planNodeOf(target)},
+			QuorumBefore: QuorumSize(len(before)),
+			QuorumAfter:  QuorumSize(len(after)),
+			StaticNodes:  staticNodesOf(list),
+		}, list, nil
+	})
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dylenfu/zion-makeup/config"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// loadChangePlan reads the only plan of the action saved in the network.
+func loadChangePlan(t *testing.T, dir, action string) *ChangePlan {
+	list, err := filepath.Glob(path.Join(dir, changesFolder, "*-"+action, "plan.json"))
+	if err != nil || len(list) != 1 {
+		t.Fatalf("expect one %s plan, got %v, err %v", action, list, err)
+	}
+	plan := new(ChangePlan)
+	if err := files.ReadJsonFile(list[0], plan); err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+// checkChangedNetwork checks the files derived from the node list of a changed network against the
+// plan, and that the genesis is kept.
+func checkChangedNetwork(t *testing.T, dir string, plan *ChangePlan, genesisHash string) []*HostNode {
+	list, err := loadNetwork(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staticNodes := make([]string, 0)
+	if err := files.ReadJsonFile(path.Join(dir, "static-nodes.json"), &staticNodes); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(staticNodes) != fmt.Sprint(staticNodesOf(list)) || fmt.Sprint(plan.StaticNodes) != fmt.Sprint(staticNodes) {
+		t.Errorf("static nodes %v, plan %v, expect %v", staticNodes, plan.StaticNodes, staticNodesOf(list))
+	}
+
+	after := validatorsOf(list)
+	if fmt.Sprint(plan.After) != fmt.Sprint(after) || plan.QuorumAfter != QuorumSize(len(after)) {
+		t.Errorf("plan validators %v quorum %d, expect %v quorum %d", plan.After, plan.QuorumAfter, after, QuorumSize(len(after)))
+	}
+	raw, err := hexutil.Decode(plan.Extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := types.ExtractHotstuffExtraPayload(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameAddresses(payload.Validators, after) {
+		t.Errorf("extra validators %v, expect %v", payload.Validators, after)
+	}
+
+	manifest := new(Manifest)
+	if err := files.ReadJsonFile(path.Join(dir, manifestFile), manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.GenesisHash.Hex() != genesisHash {
+		t.Errorf("manifest genesis hash %s, expect %s", manifest.GenesisHash.Hex(), genesisHash)
+	}
+	listed := make(map[string]bool)
+	for _, v := range manifest.Files {
+		listed[v.Path] = true
+	}
+	for _, v := range list {
+		if p := fmt.Sprintf("nodes/node%d/pubkey", v.Index); !listed[p] {
+			t.Errorf("%s is not listed in manifest", p)
+		}
+	}
+	if err := VerifyManifest("test"); err != nil {
+		t.Error(err)
+	}
+	return list
+}
+
+func TestAddValidators(t *testing.T) {
+	dir := generateTestNetwork(t, 4)
+	before := hashFiles(t, dir)
+
+	if err := AddValidators("test", 3); err != nil {
+		t.Fatal(err)
+	}
+	after := hashFiles(t, dir)
+	for i := 0; i < 4; i++ {
+		p := fmt.Sprintf("nodes/node%d/nodekey", i)
+		if after[p] != before[p] {
+			t.Errorf("%s changed", p)
+		}
+	}
+	for _, p := range []string{"genesis.json", genesisHashFile} {
+		if after[p] != before[p] {
+			t.Errorf("%s changed", p)
+		}
+	}
+
+	plan := loadChangePlan(t, dir, "add")
+	list := checkChangedNetwork(t, dir, plan, strings.TrimSpace(readTestFile(t, path.Join(dir, genesisHashFile))))
+	if len(list) != 7 || list[6].Index != 6 || len(plan.Before) != 4 || len(plan.Propose) != 3 || len(plan.NewNodes) != 3 {
+		t.Fatalf("unexpected plan %+v with %d nodes", plan, len(list))
+	}
+	for i, v := range plan.NewNodes {
+		if v.Index != 4+i || v.Address != plan.Propose[i] || v.Address != list[4+i].Node.Address {
+			t.Errorf("new node %d: %+v, expect node%d %s", i, v, 4+i, list[4+i].Node.Address.Hex())
+		}
+	}
+}
+
+// archivedKey returns the sha256 of the only archived key of the node for the action.
+func archivedKey(t *testing.T, dir, action string, index int) string {
+	list, err := filepath.Glob(path.Join(dir, archiveFolder, "*-"+action, fmt.Sprintf("node%d", index), "nodekey"))
+	if err != nil || len(list) != 1 {
+		t.Fatalf("expect one archived key of node%d, got %v, err %v", index, list, err)
+	}
+	enc, err := ioutil.ReadFile(list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(enc))
+}
+
+func TestRemoveValidators(t *testing.T) {
+	dir := generateTestNetwork(t, 7)
+	config.Conf.FaultTolerance = 1
+	genesisHash := strings.TrimSpace(readTestFile(t, path.Join(dir, genesisHashFile)))
+	before := hashFiles(t, dir)
+	list, err := loadNetwork(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveValidators("test", []int{1}, []string{list[3].Node.Address.Hex()}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	plan := loadChangePlan(t, dir, "remove")
+	remaining := checkChangedNetwork(t, dir, plan, genesisHash)
+	indexes := make([]int, 0)
+	for _, v := range remaining {
+		indexes = append(indexes, v.Index)
+	}
+	if fmt.Sprint(indexes) != "[0 2 4 5 6]" || len(plan.Before) != 7 || !sameAddresses(plan.Remove, []common.Address{list[1].Node.Address, list[3].Node.Address}) {
+		t.Fatalf("remaining nodes %v, plan %+v", indexes, plan)
+	}
+	for _, index := range []int{1, 3} {
+		p := fmt.Sprintf("nodes/node%d/nodekey", index)
+		if archivedKey(t, dir, "remove", index) != before[p] {
+			t.Errorf("archived key of node%d differs from %s", index, p)
+		}
+	}
+
+	// 3 validators can not tolerate the configured 1 faulty
+	before = hashFiles(t, dir)
+	err = RemoveValidators("test", []int{5, 6}, nil, false, false)
+	if err == nil || !strings.Contains(err.Error(), "can not tolerate 1 faulty") || !strings.Contains(err.Error(), "-unsafe") {
+		t.Fatalf("expect the fault tolerance refused, got %v", err)
+	}
+	if after := hashFiles(t, dir); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Fatal("refused removal changed the network")
+	}
+	if err := RemoveValidators("test", []int{5, 6}, nil, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(warnings, "\n"), "removed anyway") {
+		t.Errorf("expect the unsafe removal warned, got %v", warnings)
+	}
+	if list, err = loadNetwork(dir); err != nil || len(list) != 3 {
+		t.Fatalf("expect 3 nodes left, got %d, err %v", len(list), err)
+	}
+
+	for _, c := range []struct {
+		indices   []int
+		addresses []string
+		err       string
+	}{
+		{[]int{9}, nil, "node9 not found"},
+		{nil, []string{"0x1"}, "invalid address"},
+		{nil, nil, "no validator selected"},
+		{[]int{0, 2, 4}, nil, "can not remove all validators"},
+	} {
+		if err := RemoveValidators("test", c.indices, c.addresses, false, true); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("remove %v %v: expect err %q, got %v", c.indices, c.addresses, c.err, err)
+		}
+	}
+}
+
+func TestRemoveValidatorsRenumber(t *testing.T) {
+	dir := generateTestNetwork(t, 5)
+	before := hashFiles(t, dir)
+	list, err := loadNetwork(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveValidators("test", []int{1}, nil, true, false); err != nil {
+		t.Fatal(err)
+	}
+	remaining := checkChangedNetwork(t, dir, loadChangePlan(t, dir, "remove"), strings.TrimSpace(readTestFile(t, path.Join(dir, genesisHashFile))))
+	after := hashFiles(t, dir)
+	for i, old := range []int{0, 2, 3, 4} {
+		if remaining[i].Index != i || remaining[i].Node.Address != list[old].Node.Address {
+			t.Errorf("node%d: index %d address %s, expect the key of node%d", i, remaining[i].Index, remaining[i].Node.Address.Hex(), old)
+		}
+		if remaining[i].Host != list[old].Host || remaining[i].Port != list[old].Port {
+			t.Errorf("node%d: endpoint %s:%d, expect the one of node%d", i, remaining[i].Host, remaining[i].Port, old)
+		}
+		if p := fmt.Sprintf("nodes/node%d/nodekey", i); after[p] != before[fmt.Sprintf("nodes/node%d/nodekey", old)] {
+			t.Errorf("%s is not the key of node%d", p, old)
+		}
+	}
+	if _, ok := after["nodes/node4/nodekey"]; ok {
+		t.Error("node4 left after renumber")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	dir := generateTestNetwork(t, 4)
+	before := hashFiles(t, dir)
+	list, err := loadNetwork(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RotateKey("test", 2); err != nil {
+		t.Fatal(err)
+	}
+	plan := loadChangePlan(t, dir, "rotate")
+	rotated := checkChangedNetwork(t, dir, plan, strings.TrimSpace(readTestFile(t, path.Join(dir, genesisHashFile))))
+	after := hashFiles(t, dir)
+
+	if after["nodes/node2/nodekey"] == before["nodes/node2/nodekey"] || archivedKey(t, dir, "rotate", 2) != before["nodes/node2/nodekey"] {
+		t.Fatal("node2 key is not rotated and archived")
+	}
+	for _, p := range []string{"nodes/node0/nodekey", "nodes/node1/nodekey", "nodes/node3/nodekey", "genesis.json"} {
+		if after[p] != before[p] {
+			t.Errorf("%s changed", p)
+		}
+	}
+	v := rotated[2]
+	if v.Index != 2 || v.Host != list[2].Host || v.Port != list[2].Port || v.Node.Address == list[2].Node.Address {
+		t.Errorf("rotated node %+v, expect node2 at %s:%d with a new key", v, list[2].Host, list[2].Port)
+	}
+	if !sameAddresses(plan.Propose, []common.Address{v.Node.Address}) || !sameAddresses(plan.Remove, []common.Address{list[2].Node.Address}) {
+		t.Errorf("plan proposes %v and removes %v", plan.Propose, plan.Remove)
+	}
+	if err := RotateKey("test", 7); err == nil || !strings.Contains(err.Error(), "node7 not found") {
+		t.Errorf("expect node7 not found, got %v", err)
+	}
+}
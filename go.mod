@@ -2,6 +2,11 @@ module github.com/dylenfu/zion-makeup
 
 go 1.15
 
-require github.com/ethereum/go-ethereum v1.10.14
+require (
+	github.com/ethereum/go-ethereum v1.10.14
+	github.com/naoina/go-stringutil v0.1.0 // indirect
+	github.com/naoina/toml v0.1.2-0.20170918210437-9fafd6967416
+	gopkg.in/yaml.v2 v2.4.0
+)
 
 replace github.com/ethereum/go-ethereum v1.10.14 => ../Zion
@@ -20,6 +20,7 @@ package log
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -58,17 +59,71 @@ const (
 
 var (
 	levels = map[int]string{
-		DebugLog: Color(Green, "[DEBUG]"),
-		InfoLog:  Color(Cyan, "[INFO ]"),
-		WarnLog:  Color(Yellow, "[WARN ]"),
-		ErrorLog: Color(Red, "[ERROR]"),
-		FatalLog: Color(Red, "[FATAL]"),
-		TraceLog: Color(Pink, "[TRACE]"),
+		DebugLog: "[DEBUG]",
+		InfoLog:  "[INFO ]",
+		WarnLog:  "[WARN ]",
+		ErrorLog: "[ERROR]",
+		FatalLog: "[FATAL]",
+		TraceLog: "[TRACE]",
+	}
+	levelColors = map[int]string{
+		DebugLog: Green,
+		InfoLog:  Cyan,
+		WarnLog:  Yellow,
+		ErrorLog: Red,
+		FatalLog: Red,
+		TraceLog: Pink,
+	}
+	// levelKeys are the level names in json logs and on the command line
+	levelKeys = map[int]string{
+		DebugLog: "debug",
+		InfoLog:  "info",
+		WarnLog:  "warn",
+		ErrorLog: "error",
+		FatalLog: "fatal",
+		TraceLog: "trace",
 	}
 	Stdout = os.Stdout
 	PATH   = "./Log/"
 )
 
+// Format denotes the encoding of log lines, it is passed to InitLog along with the outputs.
+type Format string
+
+const (
+	TextFormat Format = "text"
+	JsonFormat Format = "json"
+)
+
+// ParseFormat returns the log format of the name.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case TextFormat, JsonFormat:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid log format %s, expect %s or %s", name, TextFormat, JsonFormat)
+}
+
+// ParseLevel returns the log level of the name, such as `debug` or `info`.
+func ParseLevel(name string) (int, error) {
+	for k, v := range levelKeys {
+		if v == strings.ToLower(name) {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %s, expect trace, debug, info, warn, error or fatal", name)
+}
+
+// isTerminal reports whether the output is a terminal, colors are only written to terminals.
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 const (
 	NAME_PREFIX          = "LEVEL"
 	CALL_DEPTH           = 2
@@ -112,18 +167,33 @@ func NameLevel(name string) int {
 	return level
 }
 
+// sink is an output of the logger, level names are colored if it is a terminal.
+type sink struct {
+	logger *log.Logger
+	color  bool
+}
+
 type Logger struct {
 	level   int
-	logger  *log.Logger
-	logFile *os.File
+	format  Format
+	sinks   []*sink
+	logFile *rotatingFile
 }
 
 func New(out io.Writer, prefix string, flag, level int, file *os.File) *Logger {
-	return &Logger{
-		level:   level,
-		logger:  log.New(out, prefix, flag),
-		logFile: file,
+	l := &Logger{
+		level:  level,
+		format: TextFormat,
+		sinks:  []*sink{{logger: log.New(out, prefix, flag), color: isTerminal(out)}},
 	}
+	if file != nil {
+		size := int64(0)
+		if fi, err := file.Stat(); err == nil {
+			size = fi.Size()
+		}
+		l.logFile = &rotatingFile{path: file.Name(), file: file, size: size}
+	}
+	return l
 }
 
 func (l *Logger) SetDebugLevel(level int) error {
@@ -137,28 +207,108 @@ func (l *Logger) SetDebugLevel(level int) error {
 
 func (l *Logger) Output(level int, a ...interface{}) error {
 	if level >= l.level {
-		gid := GetGID()
-		gidStr := strconv.FormatUint(gid, 10)
-
-		a = append([]interface{}{LevelName(level), "GID",
-			gidStr + ","}, a...)
-
-		return l.logger.Output(CALL_DEPTH, fmt.Sprintln(a...))
+		return l.write(level, strings.TrimSuffix(fmt.Sprintln(a...), "\n"), nil)
 	}
 	return nil
 }
 
 func (l *Logger) Outputf(level int, format string, v ...interface{}) error {
 	if level >= l.level {
-		gid := GetGID()
-		v = append([]interface{}{LevelName(level), "GID",
-			gid}, v...)
+		return l.write(level, fmt.Sprintf(format, v...), nil)
+	}
+	return nil
+}
 
-		return l.logger.Output(CALL_DEPTH, fmt.Sprintf("%s %s %d, "+format+"\n", v...))
+// OutputKV writes the message with fields given as alternating keys and values.
+func (l *Logger) OutputKV(level int, msg string, kv ...interface{}) error {
+	if level >= l.level {
+		return l.write(level, msg, kv)
 	}
 	return nil
 }
 
+func (l *Logger) write(level int, msg string, kv []interface{}) error {
+	gid := GetGID()
+	var line, colored string
+	if l.format == JsonFormat {
+		line = encodeJson(time.Now(), level, gid, msg, kv)
+	} else {
+		fields := encodeText(kv)
+		line = fmt.Sprintf("%s GID %d, %s%s\n", LevelName(level), gid, msg, fields)
+		colored = fmt.Sprintf("%s GID %d, %s%s\n", Color(levelColors[level], LevelName(level)), gid, msg, fields)
+	}
+
+	var err error
+	for _, s := range l.sinks {
+		out := line
+		if s.color && colored != "" {
+			out = colored
+		}
+		if e := s.logger.Output(CALL_DEPTH+1, out); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// kvPair returns the i-th key and value of the fields, a key without value is kept with nil.
+func kvPair(kv []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(kv[i])
+	if i+1 < len(kv) {
+		return key, kv[i+1]
+	}
+	return key, nil
+}
+
+func encodeText(kv []interface{}) string {
+	buf := new(strings.Builder)
+	for i := 0; i < len(kv); i += 2 {
+		key, v := kvPair(kv, i)
+		value := fmt.Sprint(v)
+		if strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(buf, " %s=%s", key, value)
+	}
+	return buf.String()
+}
+
+func writeJsonValue(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	enc, err := json.Marshal(v)
+	if err != nil {
+		enc, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(enc)
+}
+
+// encodeJson encodes a log line as a json object of time, level, message, gid and the fields.
+func encodeJson(t time.Time, level int, gid uint64, msg string, kv []interface{}) string {
+	name, ok := levelKeys[level]
+	if !ok {
+		name = strconv.Itoa(level)
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString(`{"time":`)
+	writeJsonValue(buf, t.UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJsonValue(buf, name)
+	buf.WriteString(`,"message":`)
+	writeJsonValue(buf, msg)
+	fmt.Fprintf(buf, `,"gid":%d`, gid)
+	for i := 0; i < len(kv); i += 2 {
+		key, v := kvPair(kv, i)
+		buf.WriteByte(',')
+		writeJsonValue(buf, key)
+		buf.WriteByte(':')
+		writeJsonValue(buf, v)
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
 func (l *Logger) Trace(a ...interface{}) {
 	l.Output(TraceLog, a...)
 }
@@ -283,6 +433,24 @@ func Info(a ...interface{}) {
 	Log.Info(a...)
 }
 
+// Debugw writes the message with fields given as alternating keys and values, so are Infow,
+// Warnw and Errorw.
+func Debugw(msg string, kv ...interface{}) {
+	Log.OutputKV(DebugLog, msg, kv...)
+}
+
+func Infow(msg string, kv ...interface{}) {
+	Log.OutputKV(InfoLog, msg, kv...)
+}
+
+func Warnw(msg string, kv ...interface{}) {
+	Log.OutputKV(WarnLog, msg, kv...)
+}
+
+func Errorw(msg string, kv ...interface{}) {
+	Log.OutputKV(ErrorLog, msg, kv...)
+}
+
 func Split(a ...interface{}) {
 	Log.Info(a...)
 	Log.Info("---------------------------------------------------------------")
@@ -325,6 +493,8 @@ func Fatalf(format string, a ...interface{}) {
 var Test = Fatal
 var Testf = Fatalf
 
+// FileOpen opens the latest log file in the directory to append, or creates a new timestamped one
+// if there is none.
 func FileOpen(path string) (*os.File, error) {
 	if fi, err := os.Stat(path); err == nil {
 		if !fi.IsDir() {
@@ -338,13 +508,20 @@ func FileOpen(path string) (*os.File, error) {
 		return nil, err
 	}
 
-	var currenttime = time.Now().Format("2006-01-02_15.04.05")
-
-	logfile, err := os.OpenFile(path+currenttime+"_LOG.log", os.O_RDWR|os.O_CREATE, 0666)
+	list, err := filepath.Glob(filepath.Join(path, logFilePattern))
 	if err != nil {
 		return nil, err
 	}
-	return logfile, nil
+	latest := ""
+	for _, v := range list {
+		if !strings.HasSuffix(v, gzipSuffix) && v > latest {
+			latest = v
+		}
+	}
+	if latest == "" {
+		return newLogFile(path)
+	}
+	return os.OpenFile(latest, os.O_WRONLY|os.O_APPEND, 0666)
 }
 
 //Init deprecated, use InitLog instead
@@ -353,40 +530,63 @@ func Init(a ...interface{}) {
 	InitLog(InfoLog, a...)
 }
 
+// InitLog sets the level and outputs of the default logger. outputs are files, or paths of log
+// files or directories, a directory gets its latest log file. A Format and a Rotation of the log
+// files may be given among them, text without rotation by default.
 func InitLog(logLevel int, a ...interface{}) {
 	writers := []io.Writer{}
-	var logFile *os.File
-	var err error
-	if len(a) == 0 {
-		writers = append(writers, ioutil.Discard)
-	} else {
-		for _, o := range a {
-			switch o.(type) {
-			case string:
-				logFile, err = FileOpen(o.(string))
-				if err != nil {
-					fmt.Println("error: open log file failed")
-					os.Exit(1)
-				}
-				writers = append(writers, logFile)
-			case *os.File:
-				writers = append(writers, o.(*os.File))
-			default:
-				fmt.Println("error: invalid log location")
-				os.Exit(1)
-			}
+	format := TextFormat
+	var rotation *Rotation
+	paths := []string{}
+	for _, o := range a {
+		switch o.(type) {
+		case Format:
+			format = o.(Format)
+		case Rotation:
+			r := o.(Rotation)
+			rotation = &r
+		case string:
+			paths = append(paths, o.(string))
+		case *os.File:
+			writers = append(writers, o.(*os.File))
+		default:
+			fmt.Println("error: invalid log location")
+			os.Exit(1)
 		}
 	}
-	fileAndStdoutWrite := io.MultiWriter(writers...)
-	Log = New(fileAndStdoutWrite, "", log.LUTC|log.Ldate|log.Lmicroseconds, logLevel, logFile)
+
+	// files are opened after all options are known
+	var logFile *rotatingFile
+	for _, p := range paths {
+		f, err := openRotatingFile(p, rotation)
+		if err != nil {
+			fmt.Println("error: open log file failed")
+			os.Exit(1)
+		}
+		logFile = f
+		writers = append(writers, f)
+	}
+	if len(writers) == 0 {
+		writers = append(writers, ioutil.Discard)
+	}
+
+	flags := log.LUTC | log.Ldate | log.Lmicroseconds
+	if format == JsonFormat {
+		// json lines carry their own time
+		flags = 0
+	}
+	sinks := make([]*sink, 0, len(writers))
+	for _, w := range writers {
+		sinks = append(sinks, &sink{logger: log.New(w, "", flags), color: format == TextFormat && isTerminal(w)})
+	}
+	Log = &Logger{level: logLevel, format: format, sinks: sinks, logFile: logFile}
 }
 
 func GetLogFileSize() (int64, error) {
-	f, e := Log.logFile.Stat()
-	if e != nil {
-		return 0, e
+	if Log.logFile == nil {
+		return 0, errors.New("no log file")
 	}
-	return f.Size(), nil
+	return Log.logFile.Size(), nil
 }
 
 func GetMaxLogChangeInterval(maxLogSize int64) int64 {
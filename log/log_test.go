@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestJsonFormat(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := &Logger{level: InfoLog, format: JsonFormat, sinks: []*sink{{logger: log.New(buf, "", 0)}}}
+	l.Debugf("hidden")
+	l.OutputKV(WarnLog, "node down", "node", 3, "err", errors.New("connection refused"), "dangling")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expect 1 line, got:\n%s", buf.String())
+	}
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"level": "warn", "message": "node down", "node": float64(3), "err": "connection refused", "dangling": nil}
+	for k, v := range expect {
+		if got, ok := entry[k]; !ok || got != v {
+			t.Errorf("%s: expect %v, got %v", k, v, got)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("time missing")
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := New(buf, "", 0, InfoLog, nil)
+	l.Infof("height %d", 10)
+	l.OutputKV(InfoLog, "synced", "peers", 3, "node", "node 1")
+
+	expect := "[INFO ] GID"
+	if strings.Contains(buf.String(), "\033[") || !strings.HasPrefix(buf.String(), expect) {
+		t.Fatalf("expect plain %q lines, got %q", expect, buf.String())
+	}
+	if !strings.Contains(buf.String(), `, height 10`) || !strings.Contains(buf.String(), `synced peers=3 node="node 1"`) {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expect := range map[string]int{"trace": TraceLog, "DEBUG": DebugLog, "info": InfoLog, "warn": WarnLog, "error": ErrorLog, "fatal": FatalLog} {
+		if level, err := ParseLevel(name); err != nil || level != expect {
+			t.Errorf("%s: expect %d, got %d, err %v", name, expect, level, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expect error for unknown level")
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("expect error for unknown format")
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "zion-makeup-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// checkLines checks that every line of the log file is written whole.
+func checkLines(t *testing.T, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, gzipSuffix) {
+		if r, err = gzip.NewReader(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var worker, seq int
+		if n, err := fmt.Sscanf(scanner.Text(), "worker %d line %d", &worker, &seq); n != 2 || err != nil {
+			t.Fatalf("broken line %q in %s", scanner.Text(), path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "setup.log")
+	f, err := openRotatingFile(path, &Rotation{MaxSize: 1, MaxFiles: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4 workers write about 4MB concurrently
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 8000; i++ {
+				fmt.Fprintf(f, "worker %d line %d %s\n", w, i, strings.Repeat("x", 100))
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("expect the log file and 2 backups, got %v", list)
+	}
+	for _, v := range list {
+		fi, err := os.Stat(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != path && !strings.HasSuffix(v, gzipSuffix) {
+			t.Errorf("backup %s is not compressed", v)
+		}
+		if fi.Size() > GetMaxLogChangeInterval(1) {
+			t.Errorf("%s of %d bytes exceeds the max size", v, fi.Size())
+		}
+		checkLines(t, v)
+	}
+}
+
+func TestFileOpenReusesLatest(t *testing.T) {
+	dir := tempDir(t) + "/"
+	first, err := FileOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.WriteString("worker 0 line 0\n")
+	first.Close()
+
+	second, err := FileOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if second.Name() != first.Name() {
+		t.Fatalf("expect %s reopened, got %s", first.Name(), second.Name())
+	}
+	second.WriteString("worker 0 line 1\n")
+	if enc, _ := ioutil.ReadFile(first.Name()); strings.Count(string(enc), "\n") != 2 {
+		t.Fatalf("expect lines appended, got %q", enc)
+	}
+}
+
+func TestLogFileSizeWithoutFile(t *testing.T) {
+	saved := Log
+	defer func() { Log = saved }()
+	InitLog(InfoLog, os.Stdout)
+	if _, err := GetLogFileSize(); err == nil {
+		t.Fatal("expect error without a log file")
+	}
+	if CheckIfNeedNewFile() {
+		t.Fatal("no file to rotate")
+	}
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// logTimeFormat names the files created in a log directory and the backups of a log file
+	logTimeFormat = "2006-01-02_15.04.05.000"
+	logFileSuffix = "_LOG.log"
+	// logFilePattern matches the files in a log directory, including those renamed by uniquePath
+	logFilePattern = "*_LOG*.log*"
+	gzipSuffix     = ".gz"
+)
+
+// Rotation denotes how log files are rotated, it is passed to InitLog along with the outputs. A
+// file is rotated before it grows over MaxSize megabytes, DEFAULT_MAX_LOG_SIZE if 0, and at most
+// MaxFiles rotated files are kept, all if 0. Rotated files are gzipped if Compress is set.
+type Rotation struct {
+	MaxSize  int64
+	MaxFiles int
+	Compress bool
+}
+
+// rotatingFile is a log file which is safe for concurrent writes and rotated by size if rotation
+// is set. a file in a log directory is rotated to a new timestamped file in the directory, others
+// are renamed to `<path>.<time>` and reopened.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	dir      bool
+	rotation *Rotation
+	file     *os.File
+	size     int64
+
+	// cleanMu serializes compressing and pruning of rotated files in the background
+	cleanMu sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// uniquePath returns the path, or the path with a counter if it exists.
+func uniquePath(p string) string {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return p
+		}
+		p = fmt.Sprintf("%s.%d%s", base, i, ext)
+	}
+}
+
+func newLogFile(dir string) (*os.File, error) {
+	p := uniquePath(filepath.Join(dir, time.Now().Format(logTimeFormat)+logFileSuffix))
+	return os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+}
+
+func openRotatingFile(path string, rotation *Rotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rotation: rotation}
+	var err error
+	if fi, e := os.Stat(path); strings.HasSuffix(path, "/") || (e == nil && fi.IsDir()) {
+		f.dir = true
+		f.file, err = FileOpen(strings.TrimSuffix(path, "/") + "/")
+	} else {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			f.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		f.file.Close()
+		return nil, err
+	}
+	f.size = fi.Size()
+	return f, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rotation != nil && f.size > 0 && f.size+int64(len(p)) > GetMaxLogChangeInterval(f.rotation.MaxSize) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size
+}
+
+func (f *rotatingFile) Name() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Name()
+}
+
+// Close closes the file after the background compression and pruning are done.
+func (f *rotatingFile) Close() error {
+	f.wg.Wait()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+func (f *rotatingFile) rotate() error {
+	rotated := f.file.Name()
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	var (
+		file *os.File
+		err  error
+	)
+	if f.dir {
+		file, err = newLogFile(filepath.Dir(rotated))
+	} else {
+		backup := uniquePath(rotated + "." + time.Now().Format(logTimeFormat))
+		if err = os.Rename(rotated, backup); err == nil {
+			rotated = backup
+			file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		}
+	}
+	if err != nil {
+		// keep logging to the old file rather than losing lines
+		if old, e := os.OpenFile(rotated, os.O_WRONLY|os.O_APPEND, 0644); e == nil {
+			f.file = old
+		}
+		return err
+	}
+	f.file, f.size = file, 0
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.cleanup(rotated)
+	}()
+	return nil
+}
+
+// backups returns the rotated files in order of time, the oldest first.
+func (f *rotatingFile) backups() ([]string, error) {
+	pattern := f.path + ".*"
+	if f.dir {
+		pattern = filepath.Join(f.path, logFilePattern)
+	}
+	list, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	active := f.Name()
+	backups := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != active {
+			backups = append(backups, v)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return strings.TrimSuffix(backups[i], gzipSuffix) < strings.TrimSuffix(backups[j], gzipSuffix)
+	})
+	return backups, nil
+}
+
+func (f *rotatingFile) cleanup(rotated string) {
+	f.cleanMu.Lock()
+	defer f.cleanMu.Unlock()
+
+	if f.rotation.Compress {
+		if err := compressFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "error: compress log file %s failed, err: %v\n", rotated, err)
+		}
+	}
+	if f.rotation.MaxFiles <= 0 {
+		return
+	}
+	backups, err := f.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: list log files failed, err: %v\n", err)
+		return
+	}
+	for len(backups) > f.rotation.MaxFiles {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: remove log file %s failed, err: %v\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// compressFile replaces the file with its gzip.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+gzipSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -19,26 +19,367 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dylenfu/zion-makeup/config"
 	"github.com/dylenfu/zion-makeup/core"
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/supervisor"
 )
 
 var (
-	nodes    int
 	filePath string
 	env      string
+	force    bool
+	backup   bool
+
+	logLevel  string
+	logFormat string
+	logFile   string
+	logRotate log.Rotation
+
+	report string
+	dryRun bool
 )
 
+// reportCommands lists the commands which print the run report of the network they changed.
+var reportCommands = map[string]bool{
+	"":                  true,
+	"generate":          true,
+	"add-validators":    true,
+	"remove-validators": true,
+	"rotate-key":        true,
+}
+
+// configFlags maps the command line flags to the config fields they override, flags take
+// precedence over environment variables, the config file and defaults.
+var configFlags = map[string]string{
+	"ips":             "IpList",
+	"start-port":      "StartPort",
+	"init-balance":    "InitBalance",
+	"fault-tolerance": "FaultTolerance",
+	"nodes":           "Nodes",
+	"chain-id":        "ChainID",
+}
+
 func init() {
-	flag.StringVar(&env, "env", "local", "environment for nodes")
-	flag.IntVar(&nodes, "nodes", 7, "denotes nodes number")
+	flag.StringVar(&env, "env", "local", "environment of the settings in config and the output dir build/<env>")
 	flag.StringVar(&filePath, "config", "config.json", "configuration file path")
+	flag.BoolVar(&force, "force", false, "overwrite the existing network of the environment")
+	flag.BoolVar(&backup, "backup", false, "move the existing network of the environment to a timestamped backup")
+	flag.StringVar(&logLevel, "log-level", "info", "log level, trace, debug, info, warn, error or fatal")
+	flag.StringVar(&logFormat, "log-format", "text", "log format, text or json")
+	flag.StringVar(&logFile, "log-file", "", "file to write logs to in addition to stdout, a directory gets a timestamped file")
+	flag.BoolVar(&dryRun, "dry-run", false, "generate in memory and print the plan against the files on disk, nothing is written")
+	flag.StringVar(&report, "report", "", "print a report of the generated network to stdout, json, logs go to stderr then")
+	flag.Int64Var(&logRotate.MaxSize, "log-max-size", 0, "rotate the log file over this size in MB, 0 to disable rotation")
+	flag.IntVar(&logRotate.MaxFiles, "log-max-files", 5, "number of rotated log files kept, all if 0")
+	flag.BoolVar(&logRotate.Compress, "log-compress", false, "gzip rotated log files")
+	for name, field := range configFlags {
+		flag.String(name, "", fmt.Sprintf("override config %s", field))
+	}
 	flag.Parse()
+
+	if err := initLog(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 }
 
+// initLog sets up the logger from the log flags, colors are only used when stdout is a terminal.
+func initLog() error {
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	format, err := log.ParseFormat(logFormat)
+	if err != nil {
+		return err
+	}
+	// stdout is kept for the report
+	stdout := os.Stdout
+	switch report {
+	case "":
+	case "json":
+		stdout = os.Stderr
+	default:
+		return fmt.Errorf("invalid report format %s, expect json", report)
+	}
+	outputs := []interface{}{format, stdout}
+	if logFile != "" {
+		outputs = append(outputs, logFile)
+	}
+	if logRotate.MaxSize > 0 {
+		outputs = append(outputs, logRotate)
+	}
+	log.InitLog(level, outputs...)
+	return nil
+}
+
+// loadConfig loads the config file and environment variables, applies the override flags and
+// validates the result, all problems are reported at once.
+func loadConfig() error {
+	errs := make(config.Errors, 0)
+	if err := config.LoadConfig(filePath, env); err != nil {
+		list, ok := err.(config.Errors)
+		if !ok {
+			return err
+		}
+		errs = append(errs, list...)
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if field, ok := configFlags[f.Name]; ok {
+			if err := config.Override(field, f.Value.String(), "flag:-"+f.Name); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	})
+
+	if err := config.Validate(); err != nil {
+		errs = append(errs, err.(config.Errors)...)
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errs
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func splitInts(s string) ([]int, error) {
+	list := make([]int, 0)
+	for _, v := range splitList(s) {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", v)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+func existPolicy() core.ExistPolicy {
+	switch {
+	case force && backup:
+		log.Error("flags -force and -backup can not be used together")
+		os.Exit(2)
+	case force:
+		return core.ForceOverwrite
+	case backup:
+		return core.BackupExisting
+	}
+	return core.AbortIfExist
+}
+
+// usage: setup [flags] [command], command defaults to `generate`.
 func main() {
-	config.LoadConfig(filePath)
-	core.Run(env, nodes, config.Conf.InitBalance)
+	// the scaffolding commands run without an existing config
+	switch flag.Arg(0) {
+	case "init-config":
+		if err := config.WriteDefault(filePath, force); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		log.Infof("default config written to %s", filePath)
+		return
+	case "schema":
+		enc, err := config.SchemaJson()
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(enc)
+		return
+	}
+
+	if err := loadConfig(); err != nil {
+		log.Error(err)
+		os.Exit(2)
+	}
+
+	cmd := flag.Arg(0)
+	if report != "" && !reportCommands[cmd] {
+		log.Errorf("command %s does not support -report", cmd)
+		os.Exit(2)
+	}
+	if dryRun && cmd != "" && cmd != "generate" {
+		log.Errorf("command %s does not support -dry-run", cmd)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd {
+	case "", "generate":
+		if dryRun {
+			err = planGenerate()
+			break
+		}
+		err = core.Run(env, config.Conf.Nodes, config.Conf.InitBalance, existPolicy())
+	case "bundle":
+		err = core.Bundle(env)
+	case "add-validators":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		count := fs.Int("count", 1, "number of validators to add")
+		fs.Parse(flag.Args()[1:])
+		err = core.AddValidators(env, *count)
+	case "remove-validators":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		indices := fs.String("nodes", "", "comma separated indices of nodes to remove")
+		addresses := fs.String("addresses", "", "comma separated addresses of validators to remove")
+		renumber := fs.Bool("renumber", false, "renumber the remaining node directories from 0")
+		unsafe := fs.Bool("unsafe", false, "remove even if the remaining validators fail the fault tolerance check")
+		fs.Parse(flag.Args()[1:])
+		var list []int
+		if list, err = splitInts(*indices); err == nil {
+			err = core.RemoveValidators(env, list, splitList(*addresses), *renumber, *unsafe)
+		}
+	case "rotate-key":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		index := fs.Int("node", -1, "index of the node whose key is rotated")
+		fs.Parse(flag.Args()[1:])
+		err = core.RotateKey(env, *index)
+	case "up":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		opts := new(core.LaunchOptions)
+		fs.StringVar(&opts.Binary, "bin", "", "path of the zion binary")
+		fs.IntVar(&opts.RPCPort, "rpc-port", 8545, "http rpc port of node0, the following nodes use the next ports")
+		restart := fs.String("restart", string(supervisor.RestartOnFailure), "restart policy of exited nodes, no, on-failure or always")
+		fs.IntVar(&opts.MaxRestarts, "max-restarts", 5, "max restarts of each node, unlimited if 0")
+		fs.DurationVar(&opts.RestartDelay, "restart-delay", 3*time.Second, "delay before an exited node restarted")
+		fs.DurationVar(&opts.StopTimeout, "stop-timeout", 30*time.Second, "time given to a node to exit before it is killed")
+		fs.BoolVar(&opts.Admin, "admin", false, "enable the admin rpc api of the nodes, which partitions of chaos need")
+		fs.Parse(flag.Args()[1:])
+		// arguments after `--` are passed to every node
+		opts.ExtraArgs = fs.Args()
+		if opts.Restart, err = supervisor.ParsePolicy(*restart); err == nil {
+			err = core.Up(env, opts)
+		}
+	case "down":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		timeout := fs.Duration("timeout", 30*time.Second, "time given to a node to exit before it is killed")
+		fs.Parse(flag.Args()[1:])
+		err = core.Down(env, *timeout)
+	case "status", "wait":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		opts := new(core.StatusOptions)
+		fs.IntVar(&opts.RPCPort, "rpc-port", 8545, "http rpc port of node0, the following nodes use the next ports")
+		endpoints := fs.String("rpc", "", "comma separated rpc endpoints of the nodes in index order")
+		height := fs.Uint64("height", 1, "block height every node should reach")
+		timeout := fs.Duration("timeout", 2*time.Minute, "time to wait for the nodes")
+		fs.DurationVar(&opts.Interval, "interval", time.Second, "interval between two queries")
+		fs.Parse(flag.Args()[1:])
+		opts.Endpoints = splitList(*endpoints)
+		if cmd == "status" {
+			err = core.Status(env, opts)
+		} else {
+			err = core.Wait(env, opts, *height, *timeout)
+		}
+	case "load":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		opts := new(core.LoadOptions)
+		fs.IntVar(&opts.RPCPort, "rpc-port", 8545, "http rpc port of node0, the following nodes use the next ports")
+		endpoints := fs.String("rpc", "", "comma separated rpc endpoints of the nodes in index order")
+		keys := fs.String("keys", "", "comma separated hex key files of extra funded senders")
+		fs.Float64Var(&opts.TPS, "tps", 10, "target transactions per second")
+		fs.IntVar(&opts.Concurrency, "concurrency", 4, "number of concurrent senders")
+		fs.DurationVar(&opts.Duration, "duration", time.Minute, "how long transactions are sent")
+		fs.IntVar(&opts.Count, "count", 0, "max number of transactions, unlimited if 0")
+		fs.DurationVar(&opts.Settle, "settle", 30*time.Second, "time to wait for the inclusion of sent transactions")
+		fs.DurationVar(&opts.Interval, "interval", 500*time.Millisecond, "interval to poll new blocks")
+		fs.StringVar(&opts.To, "to", "", "contract to call instead of transfers between senders")
+		fs.StringVar(&opts.Data, "data", "", "hex call data of the contract call")
+		value := fs.String("value", "1", "value in wei of each transaction")
+		fs.Uint64Var(&opts.Gas, "gas", 0, "gas limit, 21000 for transfers and 200000 for calls if 0")
+		fs.Parse(flag.Args()[1:])
+		opts.Endpoints, opts.KeyFiles = splitList(*endpoints), splitList(*keys)
+		var ok bool
+		if opts.Value, ok = new(big.Int).SetString(*value, 10); !ok {
+			err = fmt.Errorf("invalid value %s", *value)
+			break
+		}
+		err = core.Load(env, opts)
+	case "chaos":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		scenario := fs.String("scenario", "", "yaml file of the chaos scenario")
+		interval := fs.Duration("interval", time.Second, "interval to poll nodes after the faults are reverted")
+		fs.Parse(flag.Args()[1:])
+		if *scenario == "" {
+			err = fmt.Errorf("scenario file required")
+			break
+		}
+		err = core.Chaos(env, *scenario, *interval)
+	case "config":
+		if sub := flag.Arg(1); sub != "print" {
+			log.Errorf("unknown config command %s", sub)
+			os.Exit(2)
+		}
+		err = config.Print(os.Stdout)
+	case "verify-manifest":
+		err = core.VerifyManifest(env)
+	case "verify":
+		var insecure int
+		if insecure, err = core.Verify(env); err == nil && insecure > 0 {
+			log.Warnf("%d secrets or directories are accessible by group or others, run `chmod -R go-rwx` on them", insecure)
+		}
+	default:
+		log.Errorf("unknown command %s", cmd)
+		os.Exit(2)
+	}
+
+	if err == nil && report != "" && !dryRun {
+		err = printReport()
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// planGenerate prints the plan of generate, as json with -report=json.
+func planGenerate() error {
+	plan, err := core.PlanGenerate(env, config.Conf.Nodes, config.Conf.InitBalance, existPolicy())
+	if err != nil {
+		return err
+	}
+	if report == "" {
+		core.PrintGeneratePlan(os.Stdout, plan)
+		return nil
+	}
+	enc, err := json.MarshalIndent(plan, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(enc, '\n'))
+	return err
+}
+
+func printReport() error {
+	r, err := core.NetworkReport(env)
+	if err != nil {
+		return err
+	}
+	enc, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(enc, '\n'))
+	return err
 }
@@ -8,6 +8,14 @@ import (
 	"path"
 )
 
+// permission policy of generated files, secrets such as node keys are only accessible by the owner.
+const (
+	SecretFileMode os.FileMode = 0600
+	PublicFileMode os.FileMode = 0644
+	SecretDirMode  os.FileMode = 0700
+	PublicDirMode  os.FileMode = 0755
+)
+
 func ReadFile(filepath string) ([]byte, error) {
 	file, err := os.OpenFile(filepath, os.O_RDONLY, 0666)
 	if err != nil {
@@ -57,5 +65,65 @@ func WriteJsonFile(path string, ptr interface{}, indent bool) (err error) {
 		return
 	}
 
-	return ioutil.WriteFile(path, enc, os.ModePerm)
+	return WriteFileAtomic(path, enc, PublicFileMode)
+}
+
+// WriteFileAtomic write data to a temp file in the same directory and rename it to the target,
+// so that an interrupted write never leaves a partial file behind.
+func WriteFileAtomic(filepath string, data []byte, perm os.FileMode) error {
+	f, err := CreateAtomic(filepath, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
+
+// AtomicFile is written through a temp file in the same directory, which is renamed to the
+// target on Commit. it is used to stream large files such as a genesis seeded from a state dump.
+type AtomicFile struct {
+	*os.File
+	target string
+	perm   os.FileMode
+}
+
+func CreateAtomic(filepath string, perm os.FileMode) (*AtomicFile, error) {
+	dir, name := path.Split(filepath)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicFile{File: tmp, target: filepath, perm: perm}, nil
+}
+
+// Commit flush the temp file and rename it to the target.
+func (f *AtomicFile) Commit() (err error) {
+	defer func() {
+		if err != nil {
+			f.Abort()
+		}
+	}()
+
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Chmod(f.perm); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), f.target)
+}
+
+// Abort close and remove the temp file, the target is left untouched.
+func (f *AtomicFile) Abort() {
+	f.Close()
+	os.Remove(f.Name())
 }
@@ -0,0 +1,291 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package supervisor runs a group of long living processes, restarts them according to a policy
+// and stops them gracefully. every process writes its output to a log file and its pid to a pid
+// file, so that it can be found and stopped by another command.
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dylenfu/zion-makeup/log"
+	"github.com/dylenfu/zion-makeup/pkg/files"
+)
+
+// Policy denotes when an exited process is restarted.
+type Policy string
+
+const (
+	RestartNever     Policy = "no"
+	RestartOnFailure Policy = "on-failure"
+	RestartAlways    Policy = "always"
+)
+
+// ParsePolicy validates the restart policy given by name.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case RestartNever, RestartOnFailure, RestartAlways:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid restart policy %s, use one of no, on-failure and always", name)
+}
+
+// pollInterval denotes how often a stopped process is checked for exit.
+const pollInterval = 100 * time.Millisecond
+
+// Process denotes a command run by the supervisor. An exited process is not restarted while its
+// HoldFile exists, which lets another command keep a killed process down for a while.
+type Process struct {
+	Name     string
+	Path     string
+	Args     []string
+	Dir      string
+	LogFile  string
+	PidFile  string
+	HoldFile string
+}
+
+// Supervisor runs processes with the restart policy. MaxRestarts limits the restarts of each
+// process if positive, and StopTimeout denotes how long a process is given to exit after SIGINT
+// before it is killed.
+type Supervisor struct {
+	Policy       Policy
+	MaxRestarts  int
+	RestartDelay time.Duration
+	StopTimeout  time.Duration
+}
+
+func openLog(p string) (*os.File, error) {
+	return os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, files.PublicFileMode)
+}
+
+func (p *Process) command() (*exec.Cmd, *os.File, error) {
+	out, err := openLog(p.LogFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command(p.Path, p.Args...)
+	cmd.Dir = p.Dir
+	cmd.Stdout, cmd.Stderr = out, out
+	// a process group of its own keeps the ctrl-c of the terminal away from the process, which
+	// is stopped by the supervisor instead of being restarted as a crash.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd, out, nil
+}
+
+// RunOnce runs the process to completion with its output appended to the log file, it is used
+// for setup steps such as initializing a datadir.
+func RunOnce(p *Process) error {
+	cmd, out, err := p.command()
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s failed, see %s, err: %v", p.Name, strings.Join(p.Args, " "), p.LogFile, err)
+	}
+	return nil
+}
+
+// Run starts all processes and supervises them until ctx is done, then stops them gracefully. it
+// also returns once every process exited for good according to the restart policy.
+func (s *Supervisor) Run(ctx context.Context, list []*Process) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = make([]string, 0)
+	)
+	for _, p := range list {
+		wg.Add(1)
+		go func(p *Process) {
+			defer wg.Done()
+			if err := s.supervise(ctx, p); err != nil {
+				log.Errorf("%s: %v", p.Name, err)
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("%s: %v", p.Name, err))
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("processes failed:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+func (s *Supervisor) supervise(ctx context.Context, p *Process) error {
+	for restarts := 0; ; restarts++ {
+		err := s.runProcess(ctx, p)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		switch {
+		case s.Policy == RestartNever, s.Policy == RestartOnFailure && err == nil:
+			log.Infof("%s exited, err: %v", p.Name, err)
+			return err
+		case s.MaxRestarts > 0 && restarts >= s.MaxRestarts:
+			return fmt.Errorf("exited after %d restarts, last err: %v", restarts, err)
+		}
+		log.Warnf("%s exited, err: %v, restart in %s", p.Name, err, s.RestartDelay)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(s.RestartDelay):
+		}
+		if !waitHold(ctx, p) {
+			return nil
+		}
+	}
+}
+
+// waitHold blocks while the hold file of the process exists, it returns false if ctx is done.
+func waitHold(ctx context.Context, p *Process) bool {
+	if p.HoldFile == "" {
+		return true
+	}
+	for held := false; ; held = true {
+		if _, err := os.Stat(p.HoldFile); os.IsNotExist(err) {
+			if held {
+				log.Infof("%s released", p.Name)
+			}
+			return true
+		}
+		if !held {
+			log.Infof("%s is held by %s", p.Name, p.HoldFile)
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// runProcess runs the process until it exits or ctx is done, in which case it is stopped.
+func (s *Supervisor) runProcess(ctx context.Context, p *Process) error {
+	cmd, out, err := p.command()
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	if p.PidFile != "" {
+		if err := files.WriteFileAtomic(p.PidFile, []byte(strconv.Itoa(pid)+"\n"), files.PublicFileMode); err != nil {
+			log.Warnf("write pid file of %s failed, err: %v", p.Name, err)
+		}
+		defer os.Remove(p.PidFile)
+	}
+	log.Infof("%s started, pid %d, log %s", p.Name, pid, p.LogFile)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	cmd.Process.Signal(os.Interrupt)
+	select {
+	case err := <-done:
+		log.Infof("%s stopped, err: %v", p.Name, err)
+	case <-time.After(s.StopTimeout):
+		log.Warnf("%s does not exit in %s, kill it", p.Name, s.StopTimeout)
+		cmd.Process.Kill()
+		<-done
+	}
+	return nil
+}
+
+// ReadPid returns the pid in the pid file, and whether the process is still alive.
+func ReadPid(pidFile string) (int, bool, error) {
+	enc, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return 0, false, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(enc)))
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid pid file %s, err: %v", pidFile, err)
+	}
+	return pid, alive(pid), nil
+}
+
+func alive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// Stop interrupts the process in the pid file and kills it if it does not exit in timeout, the
+// pid file is removed once the process is gone. it is used to stop processes started by another
+// command, which can not be waited for.
+func Stop(pidFile string, timeout time.Duration) error {
+	pid, ok, err := ReadPid(pidFile)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Infof("process %d in %s is not running", pid, pidFile)
+		return os.Remove(pidFile)
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := proc.Signal(os.Interrupt); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(timeout); alive(pid); time.Sleep(pollInterval) {
+		if time.Now().After(deadline) {
+			log.Warnf("process %d does not exit in %s, kill it", pid, timeout)
+			if err := proc.Kill(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	log.Infof("process %d in %s stopped", pid, pidFile)
+
+	if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
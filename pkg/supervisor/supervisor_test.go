@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2021 The Zion Authors
+ * This file is part of The Zion library.
+ *
+ * The Zion is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The Zion is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The Zion.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package supervisor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stub is a node binary which exits with the code in $1, or runs until interrupted if none given.
+const stub = `#!/bin/sh
+trap 'echo stopped; exit 0' INT TERM
+echo "started $$"
+if [ -n "$1" ]; then
+    exit "$1"
+fi
+while true; do sleep 0.05; done
+`
+
+func writeStub(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "zion-makeup-supervisor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	p := path.Join(dir, "node.sh")
+	if err := ioutil.WriteFile(p, []byte(stub), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func process(dir, name string, args ...string) *Process {
+	return &Process{
+		Name:    name,
+		Path:    path.Join(dir, "node.sh"),
+		Args:    args,
+		LogFile: path.Join(dir, name+".log"),
+		PidFile: path.Join(dir, name+".pid"),
+	}
+}
+
+func readLog(t *testing.T, p *Process) string {
+	enc, err := ioutil.ReadFile(p.LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(enc)
+}
+
+// waitStarted waits until the stub reports started, by which its trap is installed.
+func waitStarted(t *testing.T, p *Process) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if enc, err := ioutil.ReadFile(p.LogFile); err == nil && strings.Contains(string(enc), "started") {
+			return
+		}
+	}
+	t.Fatalf("%s not started", p.Name)
+}
+
+func TestRestartPolicy(t *testing.T) {
+	dir := writeStub(t)
+	cases := []struct {
+		policy Policy
+		code   string
+		starts int
+		fail   bool
+	}{
+		{RestartNever, "1", 1, true},
+		{RestartOnFailure, "0", 1, false},
+		{RestartOnFailure, "1", 3, true},
+		{RestartAlways, "0", 3, true},
+	}
+	for i, c := range cases {
+		s := &Supervisor{Policy: c.policy, MaxRestarts: 2, RestartDelay: time.Millisecond, StopTimeout: time.Second}
+		p := process(dir, string(c.policy)+c.code, c.code)
+		err := s.Run(context.Background(), []*Process{p})
+		if (err != nil) != c.fail {
+			t.Errorf("case %d: unexpected err %v", i, err)
+		}
+		if starts := strings.Count(readLog(t, p), "started"); starts != c.starts {
+			t.Errorf("case %d: expect %d starts, got %d", i, c.starts, starts)
+		}
+		if _, err := os.Stat(p.PidFile); !os.IsNotExist(err) {
+			t.Errorf("case %d: pid file should be removed", i)
+		}
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	dir := writeStub(t)
+	list := []*Process{process(dir, "node0"), process(dir, "node1")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	s := &Supervisor{Policy: RestartAlways, RestartDelay: time.Millisecond, StopTimeout: 5 * time.Second}
+	go func() { done <- s.Run(ctx, list) }()
+
+	for _, p := range list {
+		waitStarted(t, p)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range list {
+		if !strings.Contains(readLog(t, p), "stopped") {
+			t.Errorf("%s is not stopped gracefully", p.Name)
+		}
+		if _, err := os.Stat(p.PidFile); !os.IsNotExist(err) {
+			t.Errorf("pid file of %s should be removed", p.Name)
+		}
+	}
+}
+
+func TestStopPidFile(t *testing.T) {
+	dir := writeStub(t)
+	p := process(dir, "node0")
+
+	cmd, out, err := p.command()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	if err := ioutil.WriteFile(p.PidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	waitStarted(t, p)
+	if err := Stop(p.PidFile, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-exited; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(readLog(t, p), "stopped") {
+		t.Error("process is not stopped gracefully")
+	}
+	if _, err := os.Stat(p.PidFile); !os.IsNotExist(err) {
+		t.Fatal("pid file should be removed")
+	}
+}
+
+func TestHoldFile(t *testing.T) {
+	dir := writeStub(t)
+	p := process(dir, "node0", "1")
+	p.HoldFile = path.Join(dir, "node0.hold")
+	if err := ioutil.WriteFile(p.HoldFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	s := &Supervisor{Policy: RestartOnFailure, MaxRestarts: 1, RestartDelay: time.Millisecond, StopTimeout: time.Second}
+	go func() { done <- s.Run(context.Background(), []*Process{p}) }()
+
+	waitStarted(t, p)
+	time.Sleep(3 * pollInterval)
+	if starts := strings.Count(readLog(t, p), "started"); starts != 1 {
+		t.Fatalf("expect 1 start while held, got %d", starts)
+	}
+	os.Remove(p.HoldFile)
+	<-done
+	if starts := strings.Count(readLog(t, p), "started"); starts != 2 {
+		t.Fatalf("expect 2 starts after release, got %d", starts)
+	}
+}